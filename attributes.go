@@ -0,0 +1,180 @@
+package kitsune
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// The maximum length of an attribute name and of an attribute data type is 256 characters.
+	maxAttributeNameLength     = 256
+	maxAttributeDataTypeLength = 256
+	// Numbers can have up to 38 digits of precision and be between -10^128 and 10^126.
+	maxNumberPrecision = 38
+)
+
+const (
+	dataTypeString = "String"
+	dataTypeNumber = "Number"
+	dataTypeBinary = "Binary"
+)
+
+var (
+	// ErrorInvalidAttributeName is returned when a message attribute name does not follow the SQS naming rules.
+	ErrorInvalidAttributeName = errors.New("invalid message attribute name")
+
+	// ErrorInvalidAttributeDataType is returned when the data type of a message attribute is not String, Number or Binary,
+	// optionally followed by a custom type label.
+	ErrorInvalidAttributeDataType = errors.New("invalid message attribute data type")
+
+	// ErrorInvalidAttributeValue is returned when a message attribute value is missing or not valid for its data type.
+	ErrorInvalidAttributeValue = errors.New("invalid message attribute value")
+)
+
+var (
+	attributeNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+	customTypeLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+	numberPattern          = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+	minNumber, _, _ = big.ParseFloat("-1e128", 10, 256, big.ToNearestEven)
+	maxNumber, _, _ = big.ParseFloat("1e126", 10, 256, big.ToNearestEven)
+)
+
+// size returns the size of the message as calculated by SQS. Every attribute adds the length of its name, data type and value.
+func size(payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue) int {
+	size := len(payload)
+
+	for name, value := range messageAttributes {
+		size += len(name) + len(aws.StringValue(value.DataType))
+
+		if baseDataType(aws.StringValue(value.DataType)) == dataTypeBinary {
+			size += len(value.BinaryValue)
+		} else {
+			size += len(aws.StringValue(value.StringValue))
+		}
+	}
+
+	return size
+}
+
+// baseDataType returns the data type without a custom type label. Eg. Number for Number.float.
+func baseDataType(dataType string) string {
+	if i := strings.Index(dataType, "."); i >= 0 {
+		return dataType[:i]
+	}
+
+	return dataType
+}
+
+// validateAttributes checks the names, data types and values of the message attributes against the rules of SQS.
+func validateAttributes(messageAttributes map[string]*sqs.MessageAttributeValue) error {
+	for name, value := range messageAttributes {
+		if !validAttributeName(name) {
+			return ErrorInvalidAttributeName
+		}
+
+		if value == nil || !validDataType(aws.StringValue(value.DataType)) {
+			return ErrorInvalidAttributeDataType
+		}
+
+		if !validAttributeValue(value) {
+			return ErrorInvalidAttributeValue
+		}
+	}
+
+	return nil
+}
+
+// validAttributeName checks that the name only contains alphanumeric characters, hyphens, underscores and periods. The name can't
+// start or end with a period, have consecutive periods or start with the reserved AWS. and Amazon. prefixes.
+func validAttributeName(name string) bool {
+	if len(name) > maxAttributeNameLength || !attributeNamePattern.MatchString(name) {
+		return false
+	}
+
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return false
+	}
+
+	lower := strings.ToLower(name)
+	return !strings.HasPrefix(lower, "aws.") && !strings.HasPrefix(lower, "amazon.")
+}
+
+func validDataType(dataType string) bool {
+	if len(dataType) > maxAttributeDataTypeLength {
+		return false
+	}
+
+	switch baseDataType(dataType) {
+	case dataTypeString, dataTypeNumber, dataTypeBinary:
+	default:
+		return false
+	}
+
+	if label := strings.TrimPrefix(dataType, baseDataType(dataType)); label != "" {
+		return customTypeLabelPattern.MatchString(label[1:])
+	}
+
+	return true
+}
+
+func validAttributeValue(value *sqs.MessageAttributeValue) bool {
+	switch baseDataType(aws.StringValue(value.DataType)) {
+	case dataTypeBinary:
+		return len(value.BinaryValue) > 0
+	case dataTypeNumber:
+		return value.StringValue != nil && validNumber(*value.StringValue)
+	default:
+		return value.StringValue != nil && *value.StringValue != "" && validString(*value.StringValue)
+	}
+}
+
+// validNumber checks that the number has at most 38 significant digits and is within the range supported by SQS.
+func validNumber(s string) bool {
+	if !numberPattern.MatchString(s) {
+		return false
+	}
+
+	mantissa := strings.TrimLeft(s, "+-")
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		mantissa = mantissa[:i]
+	}
+
+	// Leading and trailing zeros are not significant
+	digits := strings.Trim(strings.Replace(mantissa, ".", "", 1), "0")
+	if len(digits) > maxNumberPrecision {
+		return false
+	}
+
+	f, _, err := big.ParseFloat(s, 10, 256, big.ToNearestEven)
+	if err != nil {
+		return false
+	}
+
+	return f.Cmp(minNumber) >= 0 && f.Cmp(maxNumber) <= 0
+}
+
+// validString checks that the string only contains the unicode characters allowed by SQS.
+func validString(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+		case r >= 0x20 && r <= 0xD7FF:
+		case r >= 0xE000 && r <= 0xFFFD:
+		case r >= 0x10000 && r <= 0x10FFFF:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
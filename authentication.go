@@ -0,0 +1,83 @@
+package kitsune
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// TamperError is returned when an encrypted message fails authentication. Either the encrypted payload or the metadata it is
+// bound to has been modified after the message was sent.
+type TamperError struct {
+	Reason string
+}
+
+func (e *TamperError) Error() string {
+	return "message has been tampered with: " + e.Reason
+}
+
+// AuthenticatedEnvelope enables binding of encrypted payloads to the message metadata. The encrypted payload is authenticated
+// together with the id of the KMS key and the attributes of the pipeline stages applied before encryption, so swapping the
+// encrypted body between messages with different metadata, or adding or stripping eg. the compression attribute, is detected.
+// When enabled, receivers also reject encrypted messages which are not authenticated. Receivers need a version of the client
+// supporting authenticated envelopes.
+func AuthenticatedEnvelope(b bool) ClientOption {
+	return func(o *options) { o.authenticatedEnvelope = b }
+}
+
+// AuthenticatedAttributes adds message attributes set by the caller to the metadata encrypted payloads are bound to. Eg. a
+// message id or a tenant. Enables AuthenticatedEnvelope.
+func AuthenticatedAttributes(names ...string) ClientOption {
+	return func(o *options) {
+		o.authenticatedEnvelope = true
+		o.authenticatedAttributes = names
+	}
+}
+
+// authenticatedAttributeNames returns the names of the attributes an encrypted payload is bound to. These are the attributes of
+// the stages before the encryption stage, which are still present when the receiver decrypts, and the attributes chosen by the
+// caller.
+func (c *Client) authenticatedAttributeNames() []string {
+	var names []string
+	for _, stage := range c.opts.pipeline {
+		if stage.kind == stageEncryption {
+			break
+		}
+
+		names = append(names, stage.attribute())
+	}
+
+	return append(names, c.opts.authenticatedAttributes...)
+}
+
+// additionalData returns the additional authenticated data the encrypted payload is bound to. Without authentication only the
+// encryption context is bound to the payload. With authentication the key id and the attributes named by the event are bound as
+// well. An attribute which is not set is bound as absent.
+func (ee *encryptedEvent) additionalData(attribute func(string) (string, bool)) []byte {
+	aad := encryptionContextAAD(ee.EncryptionContext)
+	if !ee.Authenticated {
+		return aad
+	}
+
+	aad = appendLengthPrefixed(aad, []byte(ee.KeyID))
+	for _, name := range ee.AuthenticatedAttributes {
+		aad = appendLengthPrefixed(aad, []byte(name))
+
+		if value, exists := attribute(name); exists {
+			aad = append(aad, 1)
+			aad = appendLengthPrefixed(aad, []byte(value))
+		} else {
+			aad = append(aad, 0)
+		}
+	}
+
+	return aad
+}
+
+// attributeValue returns the value of a message attribute as a string. Binary values are returned as is.
+func attributeValue(value *sqs.MessageAttributeValue) string {
+	if value.StringValue == nil && value.BinaryValue != nil {
+		return string(value.BinaryValue)
+	}
+
+	return aws.StringValue(value.StringValue)
+}
@@ -0,0 +1,216 @@
+package kitsune
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+)
+
+// The maximum number of entries in a SQS batch request is 10.
+const maxBatchSize = 10
+
+// ErrorMissingBatchResult is returned for an entry when SQS reports neither success nor failure for it.
+var ErrorMissingBatchResult = errors.New("no result returned for batch entry")
+
+// BatchEntry is a single message to be sent with SendMessageBatch. ID is not sent to SQS, but is returned on the BatchResult so
+// the caller can correlate results with entries. Options are applied to this entry only.
+type BatchEntry struct {
+	ID                string
+	Payload           []byte
+	MessageAttributes map[string]*sqs.MessageAttributeValue
+	Options           []SendOption
+}
+
+// BatchResult is the outcome of sending a single BatchEntry. Err is nil if the entry was successfully put on the queue.
+type BatchResult struct {
+	SendResult
+	ID  string
+	Err error
+}
+
+// preparedEntry is a BatchEntry which has been through the send pipeline and is ready to be put on the queue.
+type preparedEntry struct {
+	index             int
+	payload           []byte
+	messageAttributes map[string]*sqs.MessageAttributeValue
+	sendOpts          sendOptions
+}
+
+// SendMessageBatch sends the entries to the specified queue. Every entry goes through the same compression, encryption and S3
+// steps as SendMessageWithAttributes. Entries are split into batches of maximum 10 entries where the combined size does not
+// exceed the maximum message size. The returned results are in the same order as the entries. A failing entry will not stop the
+// remaining entries from being sent, so check the error on every result. Payloads uploaded to S3 for failed entries are deleted.
+func (c *Client) SendMessageBatch(queueName *string, entries []BatchEntry) []BatchResult {
+	return c.SendMessageBatchWithContext(aws.BackgroundContext(), queueName, entries)
+}
+
+// SendMessageBatchWithContext is the same as SendMessageBatch with the addition of a context. The context is passed on to every
+// call to SQS, S3 and KMS.
+func (c *Client) SendMessageBatchWithContext(ctx aws.Context, queueName *string, entries []BatchEntry) []BatchResult {
+	results := make([]BatchResult, len(entries))
+
+	var prepared []*preparedEntry
+	for i, entry := range entries {
+		results[i].ID = entry.ID
+
+		sendOpts := c.newSendOptions(queueName, entry.Payload, entry.Options)
+		if err := validateFIFO(queueName, &sendOpts); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		payload, messageAttributes, err := c.prepareMessage(ctx, entry.Payload, entry.MessageAttributes, &sendOpts, &results[i].SendResult)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		if err := validateMessage(payload, messageAttributes); err != nil {
+			c.deleteUnsentPayload(&results[i].SendResult)
+			results[i].Err = err
+			continue
+		}
+
+		prepared = append(prepared, &preparedEntry{
+			index:             i,
+			payload:           payload,
+			messageAttributes: messageAttributes,
+			sendOpts:          sendOpts,
+		})
+	}
+
+	for _, batch := range splitBatches(prepared) {
+		c.sendBatch(ctx, queueName, batch, results)
+	}
+
+	return results
+}
+
+// splitBatches groups entries into batches which satisfies both the max number of entries and the max total size of a batch.
+func splitBatches(entries []*preparedEntry) [][]*preparedEntry {
+	var batches [][]*preparedEntry
+	var current []*preparedEntry
+	currentSize := 0
+
+	for _, entry := range entries {
+		entrySize := size(entry.payload, entry.messageAttributes)
+		if len(current) == maxBatchSize || (len(current) > 0 && currentSize+entrySize > maxMessageSize) {
+			batches = append(batches, current)
+			current = nil
+			currentSize = 0
+		}
+
+		current = append(current, entry)
+		currentSize += entrySize
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// sendBatch sends a single batch and writes the outcome for each entry to results. The batch entry id is the position of the
+// entry in the batch. Payloads uploaded to S3 are deleted for the entries which failed.
+func (c *Client) sendBatch(ctx aws.Context, queueName *string, batch []*preparedEntry, results []BatchResult) {
+	requestEntries := make([]*sqs.SendMessageBatchRequestEntry, len(batch))
+	for i, entry := range batch {
+		requestEntries[i] = &sqs.SendMessageBatchRequestEntry{
+			DelaySeconds:           delaySeconds(queueName, &entry.sendOpts),
+			Id:                     aws.String(strconv.Itoa(i)),
+			MessageAttributes:      entry.messageAttributes,
+			MessageBody:            aws.String(string(entry.payload)),
+			MessageDeduplicationId: optionalString(entry.sendOpts.messageDeduplicationID),
+			MessageGroupId:         optionalString(entry.sendOpts.messageGroupID),
+		}
+	}
+
+	output, err := c.awsSQSClient.sendMessageBatch(ctx, queueName, requestEntries)
+	if err != nil {
+		for _, entry := range batch {
+			c.deleteUnsentPayload(&results[entry.index].SendResult)
+			results[entry.index].Err = err
+		}
+		return
+	}
+
+	successful := make(map[string]*sqs.SendMessageBatchResultEntry)
+	for _, entry := range output.Successful {
+		successful[aws.StringValue(entry.Id)] = entry
+	}
+
+	failed := make(map[string]*sqs.BatchResultErrorEntry)
+	for _, entry := range output.Failed {
+		failed[aws.StringValue(entry.Id)] = entry
+	}
+
+	for i, entry := range batch {
+		id := strconv.Itoa(i)
+		result := &results[entry.index]
+		if f, exists := failed[id]; exists {
+			c.deleteUnsentPayload(&result.SendResult)
+			result.Err = fmt.Errorf("error sending message in batch: %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+		} else if s, exists := successful[id]; exists {
+			result.MessageID = aws.StringValue(s.MessageId)
+			result.MD5OfMessageBody = aws.StringValue(s.MD5OfMessageBody)
+			result.SequenceNumber = aws.StringValue(s.SequenceNumber)
+		} else {
+			// The entry might have been put on the queue, so the payload is kept
+			result.Err = ErrorMissingBatchResult
+		}
+	}
+}
+
+// DeleteMessageBatch removes the messages from the queue. Receipt handles are split into batches of maximum 10 messages. The
+// returned errors are in the same order as the receipt handles and are nil for messages which were deleted. As with
+// DeleteMessage, heartbeats are stopped and payloads are deleted from S3 if DeleteS3Payloads is enabled.
+func (c *Client) DeleteMessageBatch(queueName *string, receiptHandles []*string) []error {
+	return c.DeleteMessageBatchWithContext(aws.BackgroundContext(), queueName, receiptHandles)
+}
+
+// DeleteMessageBatchWithContext is the same as DeleteMessageBatch with the addition of a context.
+func (c *Client) DeleteMessageBatchWithContext(ctx aws.Context, queueName *string, receiptHandles []*string) []error {
+	for _, receiptHandle := range receiptHandles {
+		c.heartbeats.stop(receiptHandle)
+	}
+
+	errs := c.awsSQSClient.deleteMessageBatch(ctx, queueName, receiptHandles)
+	for i, receiptHandle := range receiptHandles {
+		if errs[i] == nil {
+			errs[i] = c.deleteS3Payload(ctx, receiptHandle)
+		}
+	}
+
+	return errs
+}
+
+// ChangeMessageVisibilityBatch changes the visibility of the messages to timeout. Messages are split into batches of maximum 10
+// messages. The returned errors are in the same order as the messages and are nil for messages which were changed. Heartbeats
+// are stopped. When timeout is 0 the messages will be received again with new receipt handles, so the client forgets their S3
+// payloads. Otherwise the payloads are still deleted with the messages.
+func (c *Client) ChangeMessageVisibilityBatch(queueName *string, messages []*sqs.Message, timeout int64) []error {
+	return c.ChangeMessageVisibilityBatchWithContext(aws.BackgroundContext(), queueName, messages, timeout)
+}
+
+// ChangeMessageVisibilityBatchWithContext is the same as ChangeMessageVisibilityBatch with the addition of a context.
+func (c *Client) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, queueName *string, messages []*sqs.Message, timeout int64) []error {
+	for _, message := range messages {
+		c.heartbeats.stop(message.ReceiptHandle)
+	}
+
+	errs := c.awsSQSClient.changeMessageVisibilityBatch(ctx, queueName, messages, timeout)
+	if timeout != 0 {
+		return errs
+	}
+
+	for i, message := range messages {
+		if errs[i] == nil {
+			c.payloads.take(message.ReceiptHandle)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,123 @@
+package kitsune
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher collects items from any number of goroutines and passes them to the send function in batches. A batch is sent when it
+// is full, when the next item would make it exceed the max batch bytes, or when the first item of the batch has waited for the
+// linger time. Used by the delete buffers and the BufferedSender.
+type batcher[T any] struct {
+	linger        time.Duration
+	maxBatchSize  int
+	maxBatchBytes int
+	send          func(batch []T)
+
+	pending      []T
+	pendingBytes int
+	timer        *time.Timer
+	closed       bool
+	lock         sync.Mutex
+
+	// Keeps track of running sends and timers so close can wait for them
+	wg sync.WaitGroup
+}
+
+// newBatcher returns a batcher passing the batches to send. A maxBatchBytes of 0 means batches are not limited by size in bytes.
+func newBatcher[T any](linger time.Duration, maxBatchSize, maxBatchBytes int, send func(batch []T)) *batcher[T] {
+	return &batcher[T]{
+		linger:        linger,
+		maxBatchSize:  maxBatchSize,
+		maxBatchBytes: maxBatchBytes,
+		send:          send,
+	}
+}
+
+// add adds the item, of the given size in bytes, to the pending batch. Returns false, without adding the item, if the batcher is
+// closed.
+func (b *batcher[T]) add(item T, size int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return false
+	}
+
+	if b.maxBatchBytes > 0 && len(b.pending) > 0 && b.pendingBytes+size > b.maxBatchBytes {
+		b.flushAsync(b.take())
+	}
+
+	b.pending = append(b.pending, item)
+	b.pendingBytes += size
+
+	if len(b.pending) == b.maxBatchSize {
+		b.flushAsync(b.take())
+	} else if len(b.pending) == 1 {
+		b.wg.Add(1)
+		b.timer = time.AfterFunc(b.linger, b.expire)
+	}
+
+	return true
+}
+
+// flush sends the pending batch without waiting for the linger time and waits for it to be sent.
+func (b *batcher[T]) flush() {
+	b.lock.Lock()
+	batch := b.take()
+	b.lock.Unlock()
+
+	b.sendBatch(batch)
+}
+
+// close sends the pending batch and waits for running sends to finish. Items are not added after close.
+func (b *batcher[T]) close() {
+	b.lock.Lock()
+	b.closed = true
+	batch := b.take()
+	b.lock.Unlock()
+
+	b.sendBatch(batch)
+	b.wg.Wait()
+}
+
+// take removes the pending items and stops the linger timer. Must be called with the lock held.
+func (b *batcher[T]) take() []T {
+	if b.timer != nil && b.timer.Stop() {
+		b.wg.Done()
+	}
+	b.timer = nil
+
+	batch := b.pending
+	b.pending = nil
+	b.pendingBytes = 0
+	return batch
+}
+
+// expire is called by the linger timer and sends the pending batch.
+func (b *batcher[T]) expire() {
+	defer b.wg.Done()
+
+	b.lock.Lock()
+	batch := b.take()
+	b.lock.Unlock()
+
+	b.sendBatch(batch)
+}
+
+// flushAsync sends the batch in a new goroutine. Must be called with the lock held.
+func (b *batcher[T]) flushAsync(batch []T) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.sendBatch(batch)
+	}()
+}
+
+func (b *batcher[T]) sendBatch(batch []T) {
+	if len(batch) == 0 {
+		return
+	}
+
+	b.send(batch)
+}
@@ -0,0 +1,411 @@
+package kitsune
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+)
+
+// AttributeNamePipeline is used to pass the order the stages of the pipeline were applied in when a custom stage is applied or
+// the built-in stages are applied in another order than the default. The value is the attribute names of the stages separated by
+// commas.
+const AttributeNamePipeline = "pipeline"
+
+var (
+	// ErrorInvalidCodec is returned by New when a custom codec uses an attribute name which is not valid in SQS or which is used by
+	// another stage or by the client.
+	ErrorInvalidCodec = errors.New("invalid codec attribute name")
+
+	// ErrorEmptyCodecValue is returned when a codec returns an empty attribute value, which SQS would reject.
+	ErrorEmptyCodecValue = errors.New("codec returned an empty attribute value")
+
+	// ErrorUnsupportedStage is returned when a message has been encoded by a stage which is not part of the receiver's pipeline.
+	ErrorUnsupportedStage = errors.New("message encoded by a stage which is not in the pipeline")
+
+	// ErrorInvalidPipeline is returned when a message is marked by a stage which is missing from the pipeline attribute.
+	ErrorInvalidPipeline = errors.New("invalid pipeline attribute")
+)
+
+// Codec is a stage in the pipeline a payload passes through before it is sent. Encode is applied when sending and Decode when
+// receiving. A message which has been encoded by a codec is marked with a message attribute named by Attribute. The value of the
+// attribute is returned by Encode and passed to Decode. The encoded payload must be valid as a SQS message body.
+type Codec interface {
+	Attribute() string
+	Encode(ctx aws.Context, payload []byte) ([]byte, string, error)
+	Decode(ctx aws.Context, payload []byte, value string) ([]byte, error)
+}
+
+type stageKind int
+
+// The built-in stages are declared in the order of the default pipeline.
+const (
+	stageCustom stageKind = iota
+	stageCompression
+	stageEncryption
+)
+
+type pipelineStage struct {
+	kind  stageKind
+	codec Codec
+}
+
+func (p pipelineStage) attribute() string {
+	switch p.kind {
+	case stageCompression:
+		return AttributeCompression
+	case stageEncryption:
+		return AttributeNameKMSKey
+	default:
+		return p.codec.Attribute()
+	}
+}
+
+// PipelineBuilder is used to define which stages a payload passes through, and in which order, before it is sent. When a custom
+// stage is applied, or the built-in stages are applied in another order than the default, the order is recorded in the pipeline
+// attribute and receivers decode the stages in the reverse of that order. Receivers need every stage used by the sender in their
+// own pipeline, but the order may differ. Upload to S3 is always done last since it depends on the size of the encoded payload.
+type PipelineBuilder struct {
+	stages []pipelineStage
+	err    error
+}
+
+// NewPipeline returns an empty PipelineBuilder.
+func NewPipeline() *PipelineBuilder {
+	return &PipelineBuilder{}
+}
+
+// Compression adds the built-in compression stage. The stage is only applied when compression is enabled.
+func (p *PipelineBuilder) Compression() *PipelineBuilder {
+	p.stages = append(p.stages, pipelineStage{kind: stageCompression})
+	return p
+}
+
+// Encryption adds the built-in KMS encryption stage. The stage is only applied when a KMS key is set.
+func (p *PipelineBuilder) Encryption() *PipelineBuilder {
+	p.stages = append(p.stages, pipelineStage{kind: stageEncryption})
+	return p
+}
+
+// Codec adds a custom stage. Custom stages are applied to every message. The attribute name of the codec has to be a valid SQS
+// attribute name which is not used by the client or by another stage, otherwise New returns ErrorInvalidCodec.
+func (p *PipelineBuilder) Codec(c Codec) *PipelineBuilder {
+	stage := pipelineStage{kind: stageCustom, codec: c}
+	if !validAttributeName(stage.attribute()) || reservedAttributeName(stage.attribute()) || p.hasStage(stage.attribute()) {
+		p.err = ErrorInvalidCodec
+	}
+
+	p.stages = append(p.stages, stage)
+	return p
+}
+
+func (p *PipelineBuilder) hasStage(name string) bool {
+	for _, stage := range p.stages {
+		if stage.attribute() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reservedAttributeName checks if the attribute name is used by the client.
+func reservedAttributeName(name string) bool {
+	switch name {
+	case AttributeNameS3Bucket, AttributeNameKMSKey, AttributeCompression, AttributeNameEncoding, AttributeNamePipeline,
+		AttributeNameExtendedPayloadSize, AttributeNameLegacyPayloadSize:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pipeline sets the stages a payload passes through before it is sent. Default is compression followed by encryption. The
+// attributes used by custom codecs are added to the message attributes returned when fetching messages.
+func Pipeline(p *PipelineBuilder) ClientOption {
+	return func(o *options) {
+		o.pipeline = append([]pipelineStage(nil), p.stages...)
+		o.pipelineErr = p.err
+
+		for _, stage := range p.stages {
+			if stage.kind == stageCustom && !containsString(o.messageAttributeNames, stage.attribute()) {
+				o.messageAttributeNames = append(o.messageAttributeNames, aws.String(stage.attribute()))
+			}
+		}
+	}
+}
+
+// encode runs the payload through the stages of the pipeline which are enabled for the message. The attributes marking which
+// stages were applied are added to messageAttributes. Unless the legacy encoding is used the built-in stages produce binary
+// output, which is signaled by the returned bool. A binary payload has to be encoded before it can be put in a message body.
+func (c *Client) encode(ctx aws.Context, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, sendOpts *sendOptions, result *SendResult) ([]byte, map[string]*sqs.MessageAttributeValue, bool, error) {
+	payld := payload
+	binaryMode := c.opts.encoding != EncodingLegacy
+	binary := false
+	var applied []pipelineStage
+
+	for _, stage := range c.opts.pipeline {
+		var value string
+		var err error
+
+		switch stage.kind {
+		case stageCompression:
+			if !sendOpts.compressionEnabled || len(payld) < c.opts.compressionThreshold {
+				continue
+			}
+
+			var compressed []byte
+			compressedLen := 0
+			if binaryMode {
+				compressed, err = compress(payld, sendOpts.compressionAlgorithm, c.opts.compressionLevelFor(sendOpts.compressionAlgorithm))
+				compressedLen = len(compressed)
+				if !binary {
+					compressedLen = encodedLen(compressedLen, c.opts.encoding)
+				}
+			} else {
+				compressed, err = compressData(payld, sendOpts.compressionAlgorithm, c.opts.compressionLevelFor(sendOpts.compressionAlgorithm))
+				compressedLen = len(compressed)
+			}
+
+			if err != nil {
+				return nil, nil, false, err
+			}
+
+			// With a threshold set the payload is sent uncompressed if compression doesn't pay off
+			if c.opts.compressionThreshold != NoCompressionThreshold && compressedLen >= len(payld) {
+				continue
+			}
+
+			payld = compressed
+			binary = binaryMode
+			value = string(sendOpts.compressionAlgorithm)
+		case stageEncryption:
+			if sendOpts.kmsKeyID == "" {
+				continue
+			}
+
+			attribute := func(name string) (string, bool) {
+				value, exists := messageAttributes[name]
+				if !exists {
+					return "", false
+				}
+
+				return attributeValue(value), true
+			}
+
+			payld, value, result.KMSKeyID, err = c.encrypt(ctx, payld, sendOpts, attribute, binaryMode)
+			binary = binaryMode
+		default:
+			payld, value, err = stage.codec.Encode(ctx, payld)
+		}
+
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		if messageAttributes == nil {
+			messageAttributes = make(map[string]*sqs.MessageAttributeValue)
+		}
+
+		// SQS rejects empty attribute values
+		if stage.kind == stageCustom && value == "" {
+			return nil, nil, false, ErrorEmptyCodecValue
+		}
+
+		messageAttributes[stage.attribute()] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		applied = append(applied, stage)
+	}
+
+	// The order only has to be recorded when receivers can't assume the default order. Saves an attribute in the common case
+	if !defaultOrder(applied) {
+		names := make([]string, len(applied))
+		for i, stage := range applied {
+			names[i] = stage.attribute()
+		}
+
+		messageAttributes[AttributeNamePipeline] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(strings.Join(names, ","))}
+	}
+
+	return payld, messageAttributes, binary, nil
+}
+
+// defaultOrder returns true if only built-in stages were applied, in the order of the default pipeline.
+func defaultOrder(applied []pipelineStage) bool {
+	for i, stage := range applied {
+		if stage.kind == stageCustom || (i > 0 && stage.kind <= applied[i-1].kind) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// appliedStages returns the stages applied by the sender in the order they were applied. The order is taken from the pipeline
+// attribute if set. Otherwise the built-in stages marked by the message attributes were applied in the default order, which is
+// also the order used by earlier versions of the client. Every stage has to be part of the receiver's pipeline.
+func (c *Client) appliedStages(attribute func(string) (string, bool)) ([]pipelineStage, error) {
+	value, exists := attribute(AttributeNamePipeline)
+	if !exists {
+		var stages []pipelineStage
+		for _, name := range []string{AttributeCompression, AttributeNameKMSKey} {
+			if _, exists := attribute(name); !exists {
+				continue
+			}
+
+			stage, exists := c.stage(name)
+			if !exists {
+				return nil, ErrorUnsupportedStage
+			}
+
+			stages = append(stages, stage)
+		}
+
+		return stages, nil
+	}
+
+	names := strings.Split(value, ",")
+	var stages []pipelineStage
+	for _, name := range names {
+		// A stage whose attribute has been stripped is skipped. Authenticated envelopes detect the stripped attribute when the
+		// payload is decrypted.
+		if _, exists := attribute(name); !exists {
+			continue
+		}
+
+		stage, exists := c.stage(name)
+		if !exists {
+			return nil, ErrorUnsupportedStage
+		}
+
+		stages = append(stages, stage)
+	}
+
+	// A stage marked on the message but left out of the order would not be decoded
+	for _, stage := range c.opts.pipeline {
+		if _, exists := attribute(stage.attribute()); exists && !containsName(names, stage.attribute()) {
+			return nil, ErrorInvalidPipeline
+		}
+	}
+
+	return stages, nil
+}
+
+// stage returns the stage of the pipeline marked by the attribute name.
+func (c *Client) stage(name string) (pipelineStage, bool) {
+	for _, stage := range c.opts.pipeline {
+		if stage.attribute() == name {
+			return stage, true
+		}
+	}
+
+	return pipelineStage{}, false
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decode reverses the send pipeline. If the payload is located in S3 it is fetched first. A payload with the encoding attribute
+// is then decoded to binary. Then the stages marked by the message attributes are decoded in the reverse of the order they were
+// applied. The attributes of the reversed stages are removed using remove. receiptHandle is used to remember the location of
+// payloads in S3 and can be nil. queueName is used to verify the encryption context and can be empty if unknown.
+func (c *Client) decode(ctx aws.Context, queueName string, body []byte, receiptHandle *string, attribute func(string) (string, bool), remove func(string)) ([]byte, error) {
+	hasAttribute := func(name string) bool {
+		_, exists := attribute(name)
+		return exists
+	}
+
+	// If a S3 pointer attribute is included the payload is located in S3 an needs to be fetched
+	if format, exists := pointerFormatOf(hasAttribute); exists {
+		if c.awsS3Client == nil {
+			return body, nil
+		}
+
+		fe, err := unmarshalPointer(body, format)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.opts.deleteS3Payloads && aws.StringValue(fe.Bucket) != c.opts.s3Bucket {
+			return nil, ErrorS3BucketNotAllowed
+		}
+
+		body, err = c.awsS3Client.getObject(ctx, fe)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.opts.deleteS3Payloads {
+			c.payloads.put(receiptHandle, fe)
+		}
+
+		for _, name := range pointerAttributeNames {
+			remove(name)
+		}
+	}
+
+	binary := false
+	if value, exists := attribute(AttributeNameEncoding); exists {
+		var err error
+		body, err = decodeBody(body, value)
+		if err != nil {
+			return nil, err
+		}
+
+		binary = true
+		remove(AttributeNameEncoding)
+	}
+
+	stages, err := c.appliedStages(attribute)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(stages) - 1; i >= 0; i-- {
+		stage := stages[i]
+		value, _ := attribute(stage.attribute())
+
+		switch stage.kind {
+		case stageCompression:
+			if binary {
+				body, err = decompress(body, value, c.opts.maxDecompressedSize)
+			} else {
+				body, err = decompressData(body, value, c.opts.maxDecompressedSize)
+			}
+		case stageEncryption:
+			if c.awsKMSClient == nil {
+				return body, nil
+			}
+
+			body, err = c.decrypt(ctx, queueName, body, attribute, binary)
+		default:
+			body, err = stage.codec.Decode(ctx, body, value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		remove(stage.attribute())
+	}
+
+	remove(AttributeNamePipeline)
+
+	return body, nil
+}
+
+func containsString(list []*string, s string) bool {
+	for _, elem := range list {
+		if aws.StringValue(elem) == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,328 @@
+package kitsune
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// CompressionAlgorithm is the algorithm used to compress payloads. The name of the algorithm is set as the value of the
+// compression message attribute so the receiver knows how to decompress the payload.
+type CompressionAlgorithm string
+
+const (
+	// CompressionGzip compresses payloads using gzip. Default algorithm.
+	CompressionGzip CompressionAlgorithm = "gzip"
+	// CompressionDeflate compresses payloads using raw deflate.
+	CompressionDeflate CompressionAlgorithm = "deflate"
+	// CompressionZstd compresses payloads using Zstandard.
+	CompressionZstd CompressionAlgorithm = "zstd"
+	// CompressionSnappy compresses payloads using the Snappy block format.
+	CompressionSnappy CompressionAlgorithm = "snappy"
+	// CompressionBrotli compresses payloads using Brotli.
+	CompressionBrotli CompressionAlgorithm = "brotli"
+)
+
+// DefaultCompressionLevel uses the default level of the selected algorithm.
+const DefaultCompressionLevel = -1
+
+// NoCompressionThreshold disables the compression threshold. All payloads are compressed when compression is enabled.
+const NoCompressionThreshold = -1
+
+// DefaultMaxDecompressedSize is the default limit of the size of a decompressed payload.
+const DefaultMaxDecompressedSize = 64 * 1024 * 1024
+
+var (
+	// ErrorUnsupportedCompression is returned when a payload is compressed with an algorithm which is not supported.
+	ErrorUnsupportedCompression = errors.New("unsupported compression algorithm")
+
+	// ErrorMaxDecompressedSizeExceeded is returned when a payload is larger than the max decompressed size when decompressed.
+	ErrorMaxDecompressedSizeExceeded = errors.New("maximum decompressed size exceeded")
+)
+
+// Compression enables compression of payloads using the specified algorithm. Compression stays disabled if it has been disabled
+// with CompressionEnabled, regardless of the order of the options.
+func Compression(a CompressionAlgorithm) ClientOption {
+	return func(o *options) {
+		o.compressionAlgorithm = a
+		o.enableCompression()
+	}
+}
+
+// CompressionLevel sets the level used when compressing payloads. The meaning of the level depends on the algorithm: gzip and
+// deflate accept 1-9, zstd accepts 1-4 (fastest to best compression) and brotli accepts 0-11. Snappy ignores the level. An
+// algorithm for which the level is not valid, eg. one set with MessageCompression, uses its default level. Use
+// CompressionLevelFor to set the level of a single algorithm. Default is DefaultCompressionLevel.
+func CompressionLevel(level int) ClientOption {
+	return func(o *options) { o.compressionLevel = level }
+}
+
+// CompressionLevelFor sets the level used when compressing payloads with the algorithm. Takes precedence over CompressionLevel.
+func CompressionLevelFor(a CompressionAlgorithm, level int) ClientOption {
+	return func(o *options) {
+		if o.compressionLevels == nil {
+			o.compressionLevels = make(map[CompressionAlgorithm]int)
+		}
+
+		o.compressionLevels[a] = level
+	}
+}
+
+// CompressionThreshold enables compression of payloads which are at least the threshold number of bytes. Smaller payloads are
+// sent uncompressed. Payloads which does not get smaller when compressed are also sent uncompressed, so the compression
+// attribute is only set when compression actually reduced the size. The size is measured before the payload is encrypted.
+// Compression stays disabled if it has been disabled with CompressionEnabled. Default is NoCompressionThreshold.
+func CompressionThreshold(threshold int) ClientOption {
+	return func(o *options) {
+		o.compressionThreshold = threshold
+		o.enableCompression()
+	}
+}
+
+// MaxDecompressedSize sets the max size of a payload after it is decompressed, which protects the receiver against payloads
+// which expand to exhaust memory. Payloads exceeding the size fail with ErrorMaxDecompressedSizeExceeded. Default is
+// DefaultMaxDecompressedSize.
+func MaxDecompressedSize(n int64) ClientOption {
+	return func(o *options) { o.maxDecompressedSize = n }
+}
+
+// enableCompression enables compression unless it has been explicitly set with CompressionEnabled.
+func (o *options) enableCompression() {
+	if !o.compressionEnabledSet {
+		o.compressionEnabled = true
+	}
+}
+
+// compressionLevelFor returns the level to use with the algorithm.
+func (o *options) compressionLevelFor(a CompressionAlgorithm) int {
+	if level, exists := o.compressionLevels[a]; exists {
+		return level
+	}
+
+	if validCompressionLevel(a, o.compressionLevel) {
+		return o.compressionLevel
+	}
+
+	return DefaultCompressionLevel
+}
+
+// validCompressionLevel checks if the level is accepted by the algorithm.
+func validCompressionLevel(a CompressionAlgorithm, level int) bool {
+	if level == DefaultCompressionLevel {
+		return true
+	}
+
+	switch a {
+	case CompressionGzip, CompressionDeflate, "":
+		return level >= flate.HuffmanOnly && level <= flate.BestCompression
+	case CompressionZstd:
+		return level >= int(zstd.SpeedFastest) && level <= int(zstd.SpeedBestCompression)
+	case CompressionBrotli:
+		return level >= brotli.BestSpeed && level <= brotli.BestCompression
+	default:
+		return true
+	}
+}
+
+// MessageCompression overrides the compression algorithm of a single message. Also enables compression for the message.
+func MessageCompression(a CompressionAlgorithm) SendOption {
+	return func(o *sendOptions) {
+		o.compressionEnabled = true
+		o.compressionAlgorithm = a
+	}
+}
+
+var (
+	zstdEncoders    = make(map[int]*zstd.Encoder)
+	zstdEncoderLock sync.Mutex
+)
+
+// zstdEncoder returns a shared encoder for the level. Encoders are safe for concurrent use of EncodeAll and expensive to create.
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdEncoderLock.Lock()
+	defer zstdEncoderLock.Unlock()
+
+	if enc, exists := zstdEncoders[level]; exists {
+		return enc, nil
+	}
+
+	encoderLevel := zstd.SpeedDefault
+	if level != DefaultCompressionLevel {
+		encoderLevel = zstd.EncoderLevel(level)
+	}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	zstdEncoders[level] = enc
+	return enc, nil
+}
+
+// The compressed string is base64 encoded because the compressed data might contain characters that are invalid and SQS would
+// throw an error
+func compressData(payload []byte, algorithm CompressionAlgorithm, level int) ([]byte, error) {
+	compressed, err := compress(payload, algorithm, level)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(compressed)))
+	base64.StdEncoding.Encode(encoded, compressed)
+	return encoded, nil
+}
+
+// compress returns the payload compressed using the algorithm. The result is binary.
+func compress(payload []byte, algorithm CompressionAlgorithm, level int) ([]byte, error) {
+	var compressed []byte
+
+	switch algorithm {
+	case CompressionGzip, "":
+		if level == DefaultCompressionLevel {
+			level = gzip.DefaultCompression
+		}
+
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeAndClose(zw, payload); err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	case CompressionDeflate:
+		if level == DefaultCompressionLevel {
+			level = flate.DefaultCompression
+		}
+
+		var buf bytes.Buffer
+		zw, err := flate.NewWriter(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeAndClose(zw, payload); err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	case CompressionZstd:
+		enc, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		compressed = enc.EncodeAll(payload, nil)
+	case CompressionSnappy:
+		compressed = s2.EncodeSnappy(nil, payload)
+	case CompressionBrotli:
+		if level == DefaultCompressionLevel {
+			level = brotli.DefaultCompression
+		}
+
+		var buf bytes.Buffer
+		if err := writeAndClose(brotli.NewWriterLevel(&buf, level), payload); err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	default:
+		return nil, ErrorUnsupportedCompression
+	}
+
+	return compressed, nil
+}
+
+// decompressData decompresses the payload using the algorithm named by the value of the compression attribute. An empty value
+// is treated as gzip, which was the only algorithm supported by earlier versions. The decompressed payload can be at most limit
+// bytes.
+func decompressData(payload []byte, algorithm string, limit int64) ([]byte, error) {
+	compressed := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+	l, err := base64.StdEncoding.Decode(compressed, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(compressed[:l], algorithm, limit)
+}
+
+// decompress reverses compress. The decompressed payload can be at most limit bytes.
+func decompress(compressed []byte, algorithm string, limit int64) ([]byte, error) {
+	switch CompressionAlgorithm(algorithm) {
+	case CompressionGzip, "":
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+
+		return readAndClose(zr, limit)
+	case CompressionDeflate:
+		return readAndClose(flate.NewReader(bytes.NewReader(compressed)), limit)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+
+		return readLimited(dec, limit)
+	case CompressionSnappy:
+		n, err := s2.DecodedLen(compressed)
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(n) > limit {
+			return nil, ErrorMaxDecompressedSizeExceeded
+		}
+
+		return s2.Decode(nil, compressed)
+	case CompressionBrotli:
+		return readLimited(brotli.NewReader(bytes.NewReader(compressed)), limit)
+	default:
+		return nil, ErrorUnsupportedCompression
+	}
+}
+
+func writeAndClose(w io.WriteCloser, payload []byte) error {
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func readAndClose(r io.ReadCloser, limit int64) ([]byte, error) {
+	decompressed, err := readLimited(r, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+
+	return decompressed, nil
+}
+
+// readLimited reads until EOF. Fails with ErrorMaxDecompressedSizeExceeded if there are more than limit bytes to read.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(decompressed)) > limit {
+		return nil, ErrorMaxDecompressedSizeExceeded
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,353 @@
+package kitsune
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"sync"
+	"time"
+)
+
+// ErrorVisibilityTimeoutLapsed is passed to the error handler of a Consumer for a message which was not handled because its
+// visibility timeout lapsed while it waited for a worker. The message might already have been received by another consumer.
+// Increase the initial visibility timeout, reduce MaxInFlight or use VisibilityHeartbeat to avoid it.
+var ErrorVisibilityTimeoutLapsed = errors.New("message visibility timeout lapsed before it was handled")
+
+// Handler processes a single message. If nil is returned the message is deleted from the queue. If an error is returned the
+// message visibility is changed using the backoff function configured on the client.
+type Handler func(message *sqs.Message) error
+
+// Consumer polls a queue and handles the lifecycle of the received messages (receive, process, delete, backoff). Pollers keep
+// receiving messages while workers are busy, as long as the number of messages in flight is below the maximum.
+type Consumer struct {
+	opts consumerOptions
+
+	client    *Client
+	queueName *string
+	handler   Handler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Number of messages received and not yet handled. Guarded by lock, pollers wait on cond for capacity
+	inFlight int
+	lock     sync.Mutex
+	cond     *sync.Cond
+
+	// Messages received, but not handled because the consumer was stopped. Guarded by lock
+	unhandled []*sqs.Message
+}
+
+// receivedMessage is a message waiting for a worker.
+type receivedMessage struct {
+	message    *sqs.Message
+	receivedAt time.Time
+	heartbeat  *Heartbeat
+}
+
+type consumerOptions struct {
+	errorHandler     func(error)
+	pollErrorDelay   time.Duration
+	heartbeat        bool
+	heartbeatOptions []HeartbeatOption
+	pollers          int
+	workers          int
+	maxInFlight      int
+}
+
+var defaultConsumerOptions = consumerOptions{
+	errorHandler:   func(error) {},
+	pollErrorDelay: 5 * time.Second,
+	pollers:        1,
+	workers:        1,
+}
+
+// ConsumerOption sets configuration options for a Consumer.
+type ConsumerOption func(*consumerOptions)
+
+// ErrorHandler sets a function which is called with errors from receiving, deleting or backing off messages. Errors returned by
+// the Handler are not passed to the error handler. Default is to ignore errors.
+func ErrorHandler(f func(error)) ConsumerOption {
+	return func(o *consumerOptions) { o.errorHandler = f }
+}
+
+// PollErrorDelay sets how long the consumer waits before polling again after a failed receive.
+func PollErrorDelay(d time.Duration) ConsumerOption {
+	return func(o *consumerOptions) { o.pollErrorDelay = d }
+}
+
+// Pollers sets the number of goroutines polling the queue. Values below 1 are set to 1. Default is 1.
+func Pollers(n int) ConsumerOption {
+	return func(o *consumerOptions) { o.pollers = n }
+}
+
+// Workers sets the number of goroutines handling messages. Values below 1 are set to 1. Default is 1.
+func Workers(n int) ConsumerOption {
+	return func(o *consumerOptions) { o.workers = n }
+}
+
+// MaxInFlight sets the maximum number of messages received and not yet handled. Pollers wait for capacity before polling, and
+// receive no more messages than there is capacity for. Default is the number of workers plus the max number of messages
+// configured on the client, so the next messages are received while the workers are busy.
+func MaxInFlight(n int) ConsumerOption {
+	return func(o *consumerOptions) { o.maxInFlight = n }
+}
+
+// VisibilityHeartbeat keeps extending the visibility of messages from when they are received until they are handled. Errors from
+// the heartbeat are passed to the error handler of the consumer unless HeartbeatErrorHandler is set.
+func VisibilityHeartbeat(opt ...HeartbeatOption) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.heartbeat = true
+		o.heartbeatOptions = opt
+	}
+}
+
+// NewConsumer returns a new Consumer which passes messages received from the queue to the handler. The consumer is started
+// by calling Start.
+func NewConsumer(client *Client, queueName *string, handler Handler, opt ...ConsumerOption) *Consumer {
+	opts := defaultConsumerOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	if opts.pollers < 1 {
+		opts.pollers = 1
+	}
+
+	if opts.workers < 1 {
+		opts.workers = 1
+	}
+
+	if opts.maxInFlight <= 0 {
+		opts.maxInFlight = opts.workers + int(client.opts.maxNumberOfMessages)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Consumer{
+		opts:      opts,
+		client:    client,
+		queueName: queueName,
+		handler:   handler,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	c.cond = sync.NewCond(&c.lock)
+
+	return c
+}
+
+// Start polls the queue and handles received messages until Stop is called. Start blocks until the consumer is stopped and
+// drained.
+func (c *Consumer) Start() {
+	messages := make(chan *receivedMessage, c.opts.maxInFlight)
+
+	var pollers sync.WaitGroup
+	for i := 0; i < c.opts.pollers; i++ {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			c.poll(messages)
+		}()
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < c.opts.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			c.work(messages)
+		}()
+	}
+
+	pollers.Wait()
+	close(messages)
+	workers.Wait()
+
+	c.resetUnhandled()
+}
+
+// Stop signals the consumer to stop. Ongoing polls are cancelled and handlers which have started are allowed to finish. The
+// visibility of messages which have been received, but not handled, is reset in batches so they can be received again right away.
+// Stop does not wait for this, wait for Start to return to know the consumer is drained.
+func (c *Consumer) Stop() {
+	c.cancel()
+
+	c.lock.Lock()
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+func (c *Consumer) poll(messages chan<- *receivedMessage) {
+	for {
+		n, ok := c.reserve()
+		if !ok {
+			return
+		}
+
+		// The visibility timeout starts when SQS returns the messages, so this is on the safe side
+		receivedAt := time.Now()
+		received, failed, err := c.client.receiveMessages(c.ctx, c.queueName, int64(n))
+		c.release(n - len(received))
+		c.fail(failed)
+
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+
+			c.opts.errorHandler(err)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(c.opts.pollErrorDelay):
+			}
+
+			continue
+		}
+
+		// Never blocks since there is capacity for every message in flight
+		for _, message := range received {
+			m := &receivedMessage{message: message, receivedAt: receivedAt}
+			if c.opts.heartbeat {
+				m.heartbeat = c.startHeartbeat(message, receivedAt)
+			}
+
+			messages <- m
+		}
+	}
+}
+
+// fail passes the error of each message which could not be unpacked to the error handler. The messages are backed off if a
+// backoff function is configured on the client, otherwise they become visible again when the initial visibility timeout expires.
+func (c *Consumer) fail(failed []failedMessage) {
+	for _, f := range failed {
+		c.opts.errorHandler(f.err)
+
+		if c.client.opts.backoffFunction == nil {
+			c.client.payloads.take(f.message.ReceiptHandle)
+			continue
+		}
+
+		if err := c.client.Backoff(c.queueName, f.message); err != nil {
+			c.opts.errorHandler(err)
+		}
+	}
+}
+
+// startHeartbeat starts the heartbeat of a message when it is received, so the message stays invisible while it waits for a
+// worker.
+func (c *Consumer) startHeartbeat(message *sqs.Message, receivedAt time.Time) *Heartbeat {
+	opt := append([]HeartbeatOption{HeartbeatErrorHandler(c.opts.errorHandler), HeartbeatReceivedAt(receivedAt)}, c.opts.heartbeatOptions...)
+	return c.client.StartHeartbeat(c.queueName, message, opt...)
+}
+
+// reserve waits until there is capacity for more messages in flight and reserves up to the max number of messages configured on
+// the client. Returns false if the consumer is stopped.
+func (c *Consumer) reserve() (int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.inFlight >= c.opts.maxInFlight && c.ctx.Err() == nil {
+		c.cond.Wait()
+	}
+
+	if c.ctx.Err() != nil {
+		return 0, false
+	}
+
+	n := c.opts.maxInFlight - c.inFlight
+	if max := int(c.client.opts.maxNumberOfMessages); n > max {
+		n = max
+	}
+
+	c.inFlight += n
+	return n, true
+}
+
+// release frees capacity for n messages.
+func (c *Consumer) release(n int) {
+	if n == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.inFlight -= n
+	c.cond.Broadcast()
+}
+
+func (c *Consumer) work(messages <-chan *receivedMessage) {
+	for m := range messages {
+		switch {
+		case c.ctx.Err() != nil:
+			c.lock.Lock()
+			c.unhandled = append(c.unhandled, m.message)
+			c.lock.Unlock()
+		case m.heartbeat == nil && c.lapsed(m):
+			c.opts.errorHandler(ErrorVisibilityTimeoutLapsed)
+			c.reset([]*sqs.Message{m.message})
+		default:
+			c.handle(m)
+		}
+
+		c.release(1)
+	}
+}
+
+// lapsed returns true if the initial visibility timeout of the message has passed since it was received.
+func (c *Consumer) lapsed(m *receivedMessage) bool {
+	timeout := c.client.opts.initialVisibilityTimeout
+	return timeout > 0 && time.Since(m.receivedAt) >= time.Duration(timeout)*time.Second
+}
+
+// resetUnhandled resets the visibility of the messages which were not handled because the consumer was stopped.
+func (c *Consumer) resetUnhandled() {
+	c.lock.Lock()
+	unhandled := c.unhandled
+	c.unhandled = nil
+	c.lock.Unlock()
+
+	c.reset(unhandled)
+}
+
+// reset makes messages which have not been handled visible again. Stops their heartbeats.
+func (c *Consumer) reset(messages []*sqs.Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	for _, err := range c.client.ChangeMessageVisibilityBatch(c.queueName, messages, 0) {
+		if err != nil {
+			c.opts.errorHandler(err)
+		}
+	}
+}
+
+func (c *Consumer) handle(m *receivedMessage) {
+	message := m.message
+	if m.heartbeat != nil {
+		defer m.heartbeat.Stop()
+	}
+
+	if err := c.handler(message); err != nil {
+		// Without a backoff function the message becomes visible again when the initial visibility timeout expires. It will be
+		// received with a new receipt handle, so there is no need to remember the payload.
+		if c.client.opts.backoffFunction == nil {
+			c.client.payloads.take(message.ReceiptHandle)
+			return
+		}
+
+		if err := c.client.Backoff(c.queueName, message); err != nil {
+			c.opts.errorHandler(err)
+		}
+
+		return
+	}
+
+	if err := c.client.DeleteMessage(c.queueName, message.ReceiptHandle); err != nil {
+		c.opts.errorHandler(err)
+	}
+}
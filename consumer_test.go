@@ -0,0 +1,445 @@
+package kitsune
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/larwef/kitsune/test"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConsumer_DeleteAndBackoff(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, BackoffFunction(ExponentialBackoff))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 3; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"+strconv.Itoa(i)))
+		test.AssertNotError(t, err)
+	}
+
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		if *message.Body == "Testpayload1" {
+			return errors.New("handler failed")
+		}
+		return nil
+	}, ErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Start()
+		close(done)
+	}()
+
+	err := sqsMock.WaitUntilMessageDeleted(&testQueue, 2)
+	test.AssertNotError(t, err)
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *requests[0].VisibilityTimeout, defaultClientOptions.initialVisibilityTimeout)
+
+	consumer.Stop()
+	<-done
+}
+
+func TestHeartbeat_StoppedOnDelete(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(100))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+
+	heartbeat := sqsClient.StartHeartbeat(&testQueue, messages[0], HeartbeatVisibilityTimeout(30), HeartbeatInterval(10*time.Millisecond),
+		HeartbeatErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 2)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *requests[0].VisibilityTimeout, int64(30))
+	test.AssertEqual(t, *requests[1].ReceiptHandle, *messages[0].ReceiptHandle)
+
+	test.AssertNotError(t, sqsClient.DeleteMessage(&testQueue, messages[0].ReceiptHandle))
+
+	select {
+	case <-heartbeat.Done():
+	default:
+		t.Error("Expected heartbeat to be stopped")
+	}
+	test.AssertEqual(t, heartbeat.Err(), nil)
+	test.AssertEqual(t, len(sqsClient.heartbeats.entries), 0)
+}
+
+func TestHeartbeat_StoppedOnChangeMessageVisibility(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(100))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	message := &sqs.Message{ReceiptHandle: aws.String("receiptHandle")}
+	heartbeat := sqsClient.StartHeartbeat(&testQueue, message, HeartbeatVisibilityTimeout(30), HeartbeatInterval(10*time.Millisecond),
+		HeartbeatErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	_, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	test.AssertNotError(t, sqsClient.ChangeMessageVisibility(&testQueue, message, 0))
+
+	select {
+	case <-heartbeat.Done():
+	default:
+		t.Error("Expected heartbeat to be stopped")
+	}
+	test.AssertEqual(t, len(sqsClient.heartbeats.entries), 0)
+}
+
+func TestHeartbeat_StoppedOnClose(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(100))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	var heartbeats []*Heartbeat
+	for i := 0; i < 3; i++ {
+		message := &sqs.Message{ReceiptHandle: aws.String("receiptHandle" + strconv.Itoa(i))}
+		heartbeats = append(heartbeats, sqsClient.StartHeartbeat(&testQueue, message, HeartbeatVisibilityTimeout(30), HeartbeatInterval(10*time.Millisecond)))
+	}
+
+	_, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 3)
+	test.AssertNotError(t, err)
+
+	test.AssertNotError(t, sqsClient.Close())
+
+	for _, heartbeat := range heartbeats {
+		select {
+		case <-heartbeat.Done():
+		default:
+			t.Error("Expected heartbeat to be stopped")
+		}
+	}
+	test.AssertEqual(t, len(sqsClient.heartbeats.entries), 0)
+}
+
+func TestHeartbeat_InvalidInterval(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	tests := []struct {
+		name string
+		opts []HeartbeatOption
+	}{
+		{"zero visibility timeout", []HeartbeatOption{HeartbeatVisibilityTimeout(0)}},
+		{"negative visibility timeout", []HeartbeatOption{HeartbeatVisibilityTimeout(-1), HeartbeatInterval(time.Second)}},
+		{"interval equal to visibility timeout", []HeartbeatOption{HeartbeatVisibilityTimeout(10), HeartbeatInterval(10 * time.Second)}},
+		{"interval longer than visibility timeout", []HeartbeatOption{HeartbeatVisibilityTimeout(10), HeartbeatInterval(time.Minute)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported []error
+			opts := append(tt.opts, HeartbeatErrorHandler(func(err error) { reported = append(reported, err) }))
+			heartbeat := sqsClient.StartHeartbeat(&testQueue, &sqs.Message{ReceiptHandle: aws.String("receiptHandle")}, opts...)
+
+			<-heartbeat.Done()
+			test.AssertEqual(t, heartbeat.Err(), ErrorInvalidHeartbeatInterval)
+			test.AssertEqual(t, len(reported), 1)
+			test.AssertEqual(t, len(sqsClient.heartbeats.entries), 0)
+			heartbeat.Stop()
+		})
+	}
+}
+
+func TestHeartbeat_ReceiptHandleExpired(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsMock.ChangeMessageVisibilityErr = awserr.New("InvalidParameterValue", "Value for parameter ReceiptHandle is invalid. Reason: The receipt handle has expired.", nil)
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	var reported []error
+	heartbeat := sqsClient.StartHeartbeat(&testQueue, &sqs.Message{ReceiptHandle: aws.String("receiptHandle")}, HeartbeatInterval(time.Millisecond),
+		HeartbeatErrorHandler(func(err error) { reported = append(reported, err) }))
+
+	<-heartbeat.Done()
+	test.AssertEqual(t, heartbeat.Err(), ErrorReceiptHandleExpired)
+	test.AssertEqual(t, len(reported), 1)
+	test.AssertEqual(t, reported[0], ErrorReceiptHandleExpired)
+}
+
+func TestHeartbeat_MaxVisibility(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	receivedAt := time.Now().Add(-maxVisibilityPeriod + 5*time.Minute)
+	heartbeat := sqsClient.StartHeartbeat(&testQueue, &sqs.Message{ReceiptHandle: aws.String("receiptHandle")}, HeartbeatVisibilityTimeout(600),
+		HeartbeatInterval(time.Millisecond), HeartbeatReceivedAt(receivedAt))
+
+	<-heartbeat.Done()
+	test.AssertEqual(t, heartbeat.Err(), ErrorMaxVisibilityReached)
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+	if timeout := *requests[0].VisibilityTimeout; timeout > 300 {
+		t.Errorf("Expected visibility timeout to be capped at 300, got %d", timeout)
+	}
+}
+
+func TestConsumer_VisibilityHeartbeat(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(100))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"))
+	test.AssertNotError(t, err)
+
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}, VisibilityHeartbeat(HeartbeatInterval(5*time.Millisecond)), ErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Start()
+		close(done)
+	}()
+
+	_, err = sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 2)
+	test.AssertNotError(t, err)
+
+	err = sqsMock.WaitUntilMessageDeleted(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	consumer.Stop()
+	<-done
+}
+
+func TestConsumer_WorkersAndDrain(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 6; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"+strconv.Itoa(i)))
+		test.AssertNotError(t, err)
+	}
+
+	started := make(chan struct{}, 6)
+	release := make(chan struct{})
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, Pollers(2), Workers(3), MaxInFlight(4), ErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Start()
+		close(done)
+	}()
+
+	// Three messages are handled concurrently
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for handlers to start")
+		}
+	}
+
+	// The pollers keep receiving while the workers are busy, but not more than the max in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		consumer.lock.Lock()
+		inFlight := consumer.inFlight
+		consumer.lock.Unlock()
+
+		if inFlight == 4 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 4 messages in flight, got %d", inFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The handlers which have started finish, and the visibility of the unstarted message is reset. The error only applies to
+	// single visibility changes, so the reset has to be batched
+	sqsMock.ChangeMessageVisibilityErr = errors.New("expected a batch")
+	consumer.Stop()
+	close(release)
+	<-done
+
+	test.AssertEqual(t, len(started), 0)
+
+	err := sqsMock.WaitUntilMessageDeleted(&testQueue, 3)
+	test.AssertNotError(t, err)
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *requests[0].VisibilityTimeout, int64(0))
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+}
+
+func TestConsumer_HeartbeatStartedOnReceive(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(100))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 2; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"+strconv.Itoa(i)))
+		test.AssertNotError(t, err)
+	}
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, Workers(1), VisibilityHeartbeat(HeartbeatInterval(5*time.Millisecond)), ErrorHandler(func(err error) { t.Errorf("Got unexpected error: %s", err) }))
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Start()
+		close(done)
+	}()
+	<-started
+
+	// The message waiting for the worker is kept invisible as well
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sqsClient.heartbeats.lock.Lock()
+		running := len(sqsClient.heartbeats.entries)
+		sqsClient.heartbeats.lock.Unlock()
+
+		if running == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 heartbeats, got %d", running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 2))
+
+	consumer.Stop()
+	<-done
+}
+
+func TestConsumer_VisibilityTimeoutLapsed(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	var reported []error
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		t.Error("Expected message not to be handled")
+		return nil
+	}, ErrorHandler(func(err error) { reported = append(reported, err) }))
+
+	// The message waited for longer than the visibility timeout and is reset instead of handled
+	messages := make(chan *receivedMessage, 1)
+	messages <- &receivedMessage{
+		message:    &sqs.Message{ReceiptHandle: aws.String("receiptHandle")},
+		receivedAt: time.Now().Add(-2 * time.Duration(defaultClientOptions.initialVisibilityTimeout) * time.Second),
+	}
+	close(messages)
+	consumer.work(messages)
+
+	test.AssertEqual(t, len(reported), 1)
+	test.AssertEqual(t, reported[0], ErrorVisibilityTimeoutLapsed)
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *requests[0].VisibilityTimeout, int64(0))
+}
+
+func TestConsumer_PollersAndWorkersAtLeastOne(t *testing.T) {
+	sqsClient := getClient(test.NewSQSMock(5, int64(10)), nil, nil)
+
+	consumer := NewConsumer(sqsClient, aws.String("test-queue"), func(message *sqs.Message) error { return nil }, Pollers(0), Workers(-1))
+	test.AssertEqual(t, consumer.opts.pollers, 1)
+	test.AssertEqual(t, consumer.opts.workers, 1)
+}
+
+func TestConsumer_UndecodableMessage(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, BackoffFunction(ExponentialBackoff))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload0"))
+	test.AssertNotError(t, err)
+
+	// Marked as compressed, but the body is not
+	_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    &testQueue,
+		MessageBody: aws.String("not compressed"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			AttributeCompression: {DataType: aws.String("String"), StringValue: aws.String(string(CompressionGzip))},
+		},
+	})
+	test.AssertNotError(t, err)
+
+	_, err = sqsClient.SendMessage(&testQueue, []byte("Testpayload2"))
+	test.AssertNotError(t, err)
+
+	handled := make(chan string, 3)
+	errs := make(chan error, 3)
+	consumer := NewConsumer(sqsClient, &testQueue, func(message *sqs.Message) error {
+		handled <- *message.Body
+		return nil
+	}, ErrorHandler(func(err error) { errs <- err }))
+
+	done := make(chan struct{})
+	go func() {
+		consumer.Start()
+		close(done)
+	}()
+
+	// The messages which can be unpacked are handled, and only the one which can't is backed off
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 2))
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *requests[0].VisibilityTimeout, defaultClientOptions.initialVisibilityTimeout)
+
+	consumer.Stop()
+	<-done
+
+	test.AssertEqual(t, len(handled), 2)
+	test.AssertEqual(t, len(errs), 1)
+}
@@ -0,0 +1,127 @@
+package kitsune
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"sync"
+	"time"
+)
+
+// DeleteBufferLinger enables buffering of DeleteMessage. Deletes to the same queue, from any number of goroutines, are collected
+// and sent as a single batch when 10 deletes are pending or when the first pending delete has waited for the linger time. Each
+// call to DeleteMessage blocks until the batch containing its message is sent and returns the result for its message. The
+// context of the call only limits how long the caller waits, the message and its S3 payload are still deleted with the batch.
+// Close sends the pending deletes. Default is 0, which deletes every message with a separate call.
+func DeleteBufferLinger(d time.Duration) ClientOption {
+	return func(o *options) { o.deleteBufferLinger = d }
+}
+
+// pendingDelete is a delete waiting in a deleteBuffer. The result of the delete is sent on result.
+type pendingDelete struct {
+	receiptHandle *string
+	result        chan error
+}
+
+// deleteBuffer collects the deletes to a single queue and sends them in batches.
+type deleteBuffer struct {
+	client    *Client
+	queueName *string
+	batcher   *batcher[*pendingDelete]
+}
+
+func newDeleteBuffer(c *Client, queueName *string, linger time.Duration) *deleteBuffer {
+	b := &deleteBuffer{
+		client:    c,
+		queueName: queueName,
+	}
+	b.batcher = newBatcher(linger, maxBatchSize, 0, b.flush)
+
+	return b
+}
+
+// delete adds the delete to the buffer and waits for the result. Deletes the message directly if the buffer is closed. The S3
+// payload of the message is deleted when the message is, also if the caller stops waiting.
+func (b *deleteBuffer) delete(ctx aws.Context, receiptHandle *string) error {
+	p := &pendingDelete{
+		receiptHandle: receiptHandle,
+		result:        make(chan error, 1),
+	}
+
+	if !b.batcher.add(p, 0) {
+		if err := b.client.awsSQSClient.deleteMessage(ctx, b.queueName, receiptHandle); err != nil {
+			return err
+		}
+
+		return b.client.deleteS3Payload(ctx, receiptHandle)
+	}
+
+	select {
+	case err := <-p.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush deletes the batch, and the S3 payloads of the deleted messages, and returns the result to each of the callers.
+func (b *deleteBuffer) flush(batch []*pendingDelete) {
+	receiptHandles := make([]*string, len(batch))
+	for i, p := range batch {
+		receiptHandles[i] = p.receiptHandle
+	}
+
+	errs := b.client.awsSQSClient.deleteMessageBatch(aws.BackgroundContext(), b.queueName, receiptHandles)
+	for i, p := range batch {
+		if errs[i] == nil {
+			errs[i] = b.client.deleteS3Payload(aws.BackgroundContext(), p.receiptHandle)
+		}
+
+		p.result <- errs[i]
+	}
+}
+
+// close sends the pending deletes and waits for running flushes to finish.
+func (b *deleteBuffer) close() {
+	b.batcher.close()
+}
+
+// deleteBuffers keeps track of the delete buffers of the client. Entries are keyed by queue name.
+type deleteBuffers struct {
+	entries map[string]*deleteBuffer
+	closed  bool
+	lock    sync.Mutex
+}
+
+// get returns the delete buffer of the queue, creating it if it does not exist. Returns nil if the buffers are closed.
+func (r *deleteBuffers) get(c *Client, queueName *string, linger time.Duration) *deleteBuffer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	if r.entries == nil {
+		r.entries = make(map[string]*deleteBuffer)
+	}
+
+	b, exists := r.entries[*queueName]
+	if !exists {
+		b = newDeleteBuffer(c, queueName, linger)
+		r.entries[*queueName] = b
+	}
+
+	return b
+}
+
+// close closes every delete buffer. Buffers are not created after close.
+func (r *deleteBuffers) close() {
+	r.lock.Lock()
+	r.closed = true
+	entries := r.entries
+	r.entries = nil
+	r.lock.Unlock()
+
+	for _, b := range entries {
+		b.close()
+	}
+}
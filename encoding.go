@@ -0,0 +1,83 @@
+package kitsune
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+)
+
+// Encoding determines how the output of the built-in compression and encryption stages is represented in the message body.
+type Encoding string
+
+const (
+	// EncodingLegacy base64 encodes compressed payloads and marshals encrypted payloads as JSON. Every stage produces valid
+	// text, so the payload grows with every stage. Default, and understood by all versions of the client.
+	EncodingLegacy Encoding = ""
+	// EncodingBase64 keeps the output of the stages binary and base64 encodes the body once. Payloads uploaded to S3 are stored
+	// raw.
+	EncodingBase64 Encoding = "base64"
+	// EncodingASCII85 keeps the output of the stages binary and ascii85 encodes the body once, which adds 25% instead of the
+	// 33% added by base64. Payloads uploaded to S3 are stored raw.
+	EncodingASCII85 Encoding = "ascii85"
+)
+
+// Value of the encoding attribute when the binary payload is stored raw in S3.
+const encodingBinary = "binary"
+
+// ErrorUnsupportedEncoding is returned when a payload is encoded with an encoding which is not supported.
+var ErrorUnsupportedEncoding = errors.New("unsupported payload encoding")
+
+// PayloadEncoding sets how the output of compression and encryption is represented in the message body. Receivers need a
+// version of the client supporting the encoding when anything other than EncodingLegacy is used. Default is EncodingLegacy.
+func PayloadEncoding(e Encoding) ClientOption {
+	return func(o *options) { o.encoding = e }
+}
+
+// encodeBody encodes the binary payload as text which is valid in a SQS message body.
+func encodeBody(payload []byte, e Encoding) ([]byte, error) {
+	switch e {
+	case EncodingBase64:
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+		base64.StdEncoding.Encode(encoded, payload)
+		return encoded, nil
+	case EncodingASCII85:
+		encoded := make([]byte, ascii85.MaxEncodedLen(len(payload)))
+		n := ascii85.Encode(encoded, payload)
+		return encoded[:n], nil
+	default:
+		return nil, ErrorUnsupportedEncoding
+	}
+}
+
+// encodedLen returns the length of a payload of n bytes after it has been encoded.
+func encodedLen(n int, e Encoding) int {
+	switch e {
+	case EncodingBase64:
+		return base64.StdEncoding.EncodedLen(n)
+	case EncodingASCII85:
+		return ascii85.MaxEncodedLen(n)
+	default:
+		return n
+	}
+}
+
+// decodeBody reverses encodeBody using the encoding named by the value of the encoding attribute.
+func decodeBody(payload []byte, value string) ([]byte, error) {
+	switch value {
+	case encodingBinary:
+		return payload, nil
+	case string(EncodingBase64):
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, payload)
+		if err != nil {
+			return nil, err
+		}
+		return decoded[:n], nil
+	case string(EncodingASCII85):
+		return ioutil.ReadAll(ascii85.NewDecoder(bytes.NewReader(payload)))
+	default:
+		return nil, ErrorUnsupportedEncoding
+	}
+}
@@ -0,0 +1,98 @@
+package kitsune
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrorEncryptionContextMismatch is returned when the encryption context of a received message does not contain the encryption
+// context expected by the receiver.
+var ErrorEncryptionContextMismatch = errors.New("encryption context of message does not match the expected encryption context")
+
+// EncryptionContext sets a static KMS encryption context added to every encrypted message. The encryption context is passed to
+// KMS, which makes it visible in CloudTrail, and is bound to the encrypted payload. Receivers with an encryption context
+// configured will only decrypt messages with a matching encryption context.
+func EncryptionContext(ec map[string]string) ClientOption {
+	return func(o *options) { o.encryptionContext = ec }
+}
+
+// EncryptionContextFunc sets a function deriving the KMS encryption context from the name of the queue. Eg. to bind encrypted
+// payloads to the queue they are sent to so they can't be replayed onto another queue. The result is merged with the static
+// encryption context. When receiving from a Lambda SQSEvent the queue name is taken from the event source ARN.
+func EncryptionContextFunc(f func(queueName string) map[string]string) ClientOption {
+	return func(o *options) { o.encryptionContextFunc = f }
+}
+
+// MessageEncryptionContext adds to the KMS encryption context of a single message. Eg. tenant or message type. Keys set on the
+// client take precedence.
+func MessageEncryptionContext(ec map[string]string) SendOption {
+	return func(o *sendOptions) { o.encryptionContext = ec }
+}
+
+// expectedEncryptionContext returns the encryption context configured on the client for the queue.
+func (c *Client) expectedEncryptionContext(queueName string) map[string]string {
+	var queueEncryptionContext map[string]string
+	if c.opts.encryptionContextFunc != nil && queueName != "" {
+		queueEncryptionContext = c.opts.encryptionContextFunc(queueName)
+	}
+
+	return mergeEncryptionContexts(c.opts.encryptionContext, queueEncryptionContext)
+}
+
+// mergeEncryptionContexts returns the union of the encryption contexts. If a key exists in several contexts the value from the
+// first one is used. Returns nil if all are empty.
+func mergeEncryptionContexts(ecs ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, ec := range ecs {
+		for k, v := range ec {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+
+			if _, exists := merged[k]; !exists {
+				merged[k] = v
+			}
+		}
+	}
+
+	return merged
+}
+
+// verifyEncryptionContext checks that every key and value of the expected encryption context is present in the actual one.
+func verifyEncryptionContext(expected, actual map[string]string) error {
+	for k, v := range expected {
+		if value, exists := actual[k]; !exists || value != v {
+			return ErrorEncryptionContextMismatch
+		}
+	}
+
+	return nil
+}
+
+// encryptionContextAAD returns the encryption context serialized with sorted keys to be used as additional authenticated data
+// when encrypting the payload. Returns nil for an empty encryption context so messages without one are encrypted as before.
+func encryptionContextAAD(ec map[string]string) []byte {
+	if len(ec) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(ec))
+	for k := range ec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var aad []byte
+	for _, k := range keys {
+		aad = appendLengthPrefixed(aad, []byte(k))
+		aad = appendLengthPrefixed(aad, []byte(ec[k]))
+	}
+
+	return aad
+}
+
+// queueNameFromARN returns the queue name from a SQS queue ARN, eg. arn:aws:sqs:eu-west-1:123456789012:myQueue.
+func queueNameFromARN(arn string) string {
+	return arn[strings.LastIndex(arn, ":")+1:]
+}
@@ -0,0 +1,292 @@
+package kitsune
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Algorithm is the algorithm used to encrypt payloads with the data key generated by KMS.
+type Algorithm string
+
+const (
+	// AlgorithmAES256GCM encrypts payloads using AES-GCM with a 256 bit data key. Default algorithm.
+	AlgorithmAES256GCM Algorithm = "AES_256_GCM"
+	// AlgorithmAES128GCM encrypts payloads using AES-GCM with a 128 bit data key.
+	AlgorithmAES128GCM Algorithm = "AES_128_GCM"
+)
+
+type algorithmSpec struct {
+	keySpec string
+	keySize int
+}
+
+var algorithms = map[Algorithm]algorithmSpec{
+	AlgorithmAES256GCM: {keySpec: kms.DataKeySpecAes256, keySize: 32},
+	AlgorithmAES128GCM: {keySpec: kms.DataKeySpecAes128, keySize: 16},
+}
+
+// Versions of the JSON envelope holding an encrypted payload.
+const (
+	// EnvelopeVersionLegacy is the envelope understood by all versions of the client. It does not record algorithm, key spec or
+	// nonce, and can only be used with AlgorithmAES256GCM.
+	EnvelopeVersionLegacy = 0
+	// EnvelopeVersion1 records the algorithm, key spec and nonce used to encrypt the payload.
+	EnvelopeVersion1 = 1
+
+	latestEnvelopeVersion = EnvelopeVersion1
+)
+
+// Version of the binary envelope holding an encrypted payload.
+const binaryEnvelopeVersion = 1
+
+// Flags set in the binary envelope.
+const envelopeFlagAuthenticated = 1
+
+var (
+	// ErrorInvalidEnvelope is returned when an encrypted payload can't be unmarshalled from the binary envelope.
+	ErrorInvalidEnvelope = errors.New("invalid binary envelope")
+
+	// ErrorUnsupportedEnvelopeVersion is returned when an encrypted payload is in a version of the envelope which is not supported.
+	ErrorUnsupportedEnvelopeVersion = errors.New("unsupported envelope version")
+
+	// ErrorUnsupportedAlgorithm is returned when a payload is encrypted with an algorithm which is not supported.
+	ErrorUnsupportedAlgorithm = errors.New("unsupported encryption algorithm")
+)
+
+// EncryptionAlgorithm sets the algorithm used to encrypt payloads. Algorithms other than AlgorithmAES256GCM are always sent
+// using EnvelopeVersion1 or later. Default is AlgorithmAES256GCM.
+func EncryptionAlgorithm(a Algorithm) ClientOption {
+	return func(o *options) { o.encryptionAlgorithm = a }
+}
+
+// EnvelopeVersion sets the version of the JSON envelope encrypted payloads are sent in. Upgrade receivers before upgrading the
+// envelope version of the senders. Payloads sent using a binary PayloadEncoding always use the binary envelope. Default is
+// EnvelopeVersionLegacy.
+func EnvelopeVersion(v int) ClientOption {
+	return func(o *options) { o.envelopeVersion = v }
+}
+
+// newEncryptedEvent returns an event with the version and algorithm to be used for encrypting a payload.
+func (c *Client) newEncryptedEvent(binary bool) *encryptedEvent {
+	ee := &encryptedEvent{Version: c.opts.envelopeVersion}
+
+	if binary || c.opts.encryptionAlgorithm != AlgorithmAES256GCM {
+		ee.Version = latestEnvelopeVersion
+	}
+
+	if ee.Version != EnvelopeVersionLegacy {
+		ee.Algorithm = c.opts.encryptionAlgorithm
+	}
+
+	return ee
+}
+
+// algorithm returns the algorithm the payload is encrypted with. The legacy envelope is always AlgorithmAES256GCM.
+func (ee *encryptedEvent) algorithm() Algorithm {
+	if ee.Version == EnvelopeVersionLegacy {
+		return AlgorithmAES256GCM
+	}
+
+	return ee.Algorithm
+}
+
+// splitPayload returns the nonce and the ciphertext of the event. In the legacy envelope the nonce is prepended to the payload.
+func (ee *encryptedEvent) splitPayload() ([]byte, []byte, error) {
+	if ee.Version != EnvelopeVersionLegacy {
+		return ee.Nonce, ee.Payload, nil
+	}
+
+	// AES-GCM uses a 12 byte nonce
+	const nonceSize = 12
+	if len(ee.Payload) < nonceSize {
+		return nil, nil, &TamperError{Reason: "encrypted payload is too short"}
+	}
+
+	return ee.Payload[:nonceSize], ee.Payload[nonceSize:], nil
+}
+
+// marshalEnvelope marshals the encrypted event as a binary envelope if binary is true and as JSON otherwise.
+func marshalEnvelope(ee *encryptedEvent, binary bool) ([]byte, error) {
+	if binary {
+		return marshalBinaryEnvelope(ee), nil
+	}
+
+	return json.Marshal(ee)
+}
+
+// unmarshalEnvelope unmarshals an encrypted event of any known version.
+func unmarshalEnvelope(payload []byte, binary bool) (*encryptedEvent, error) {
+	if binary {
+		return unmarshalBinaryEnvelope(payload)
+	}
+
+	ee := &encryptedEvent{}
+	if err := json.Unmarshal(payload, ee); err != nil {
+		return nil, err
+	}
+
+	if ee.Version < EnvelopeVersionLegacy || ee.Version > latestEnvelopeVersion {
+		return nil, ErrorUnsupportedEnvelopeVersion
+	}
+
+	return ee, nil
+}
+
+// marshalBinaryEnvelope marshals the encrypted event as a version byte followed by the length prefixed key id and encrypted data
+// key. Then follows the number of encryption context entries and the length prefixed key and value of each entry, sorted by key.
+// Then a flags byte and the number of authenticated attributes followed by their length prefixed names. Then the length prefixed
+// algorithm, key spec and nonce. The rest of the envelope is the encrypted payload. The event has to be of version 1 or later.
+func marshalBinaryEnvelope(ee *encryptedEvent) []byte {
+	aad := encryptionContextAAD(ee.EncryptionContext)
+
+	buf := make([]byte, 0, 2+7*binary.MaxVarintLen64+len(ee.KeyID)+len(ee.EncryptedEncryptionKey)+len(aad)+len(ee.Algorithm)+len(ee.KeySpec)+len(ee.Nonce)+len(ee.Payload))
+	buf = append(buf, binaryEnvelopeVersion)
+	buf = appendLengthPrefixed(buf, []byte(ee.KeyID))
+	buf = appendLengthPrefixed(buf, ee.EncryptedEncryptionKey)
+	buf = appendUvarint(buf, uint64(len(ee.EncryptionContext)))
+	buf = append(buf, aad...)
+
+	var flags byte
+	if ee.Authenticated {
+		flags |= envelopeFlagAuthenticated
+	}
+	buf = append(buf, flags)
+	buf = appendUvarint(buf, uint64(len(ee.AuthenticatedAttributes)))
+	for _, name := range ee.AuthenticatedAttributes {
+		buf = appendLengthPrefixed(buf, []byte(name))
+	}
+
+	buf = appendLengthPrefixed(buf, []byte(ee.Algorithm))
+	buf = appendLengthPrefixed(buf, []byte(ee.KeySpec))
+	buf = appendLengthPrefixed(buf, ee.Nonce)
+
+	return append(buf, ee.Payload...)
+}
+
+// unmarshalBinaryEnvelope unmarshals an encrypted event marshalled by marshalBinaryEnvelope.
+func unmarshalBinaryEnvelope(envelope []byte) (*encryptedEvent, error) {
+	if len(envelope) == 0 || envelope[0] != binaryEnvelopeVersion {
+		return nil, ErrorInvalidEnvelope
+	}
+
+	keyID, rest, err := readLengthPrefixed(envelope[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	ee := &encryptedEvent{
+		EncryptedEncryptionKey: encryptedKey,
+		KeyID:                  string(keyID),
+		Version:                EnvelopeVersion1,
+	}
+
+	if ee.EncryptionContext, rest, err = readEncryptionContext(rest); err != nil {
+		return nil, err
+	}
+
+	if len(rest) == 0 {
+		return nil, ErrorInvalidEnvelope
+	}
+
+	ee.Authenticated = rest[0]&envelopeFlagAuthenticated != 0
+	if ee.AuthenticatedAttributes, rest, err = readNames(rest[1:]); err != nil {
+		return nil, err
+	}
+
+	var algorithm, keySpec []byte
+	if algorithm, rest, err = readLengthPrefixed(rest); err != nil {
+		return nil, err
+	}
+
+	if keySpec, rest, err = readLengthPrefixed(rest); err != nil {
+		return nil, err
+	}
+
+	if ee.Nonce, rest, err = readLengthPrefixed(rest); err != nil {
+		return nil, err
+	}
+
+	ee.Algorithm = Algorithm(algorithm)
+	ee.KeySpec = string(keySpec)
+	ee.Payload = rest
+	return ee, nil
+}
+
+func readNames(buf []byte) ([]string, []byte, error) {
+	count, n := binary.Uvarint(buf)
+	// Every name is at least one byte
+	if n <= 0 || count > uint64(len(buf)-n) {
+		return nil, nil, ErrorInvalidEnvelope
+	}
+	buf = buf[n:]
+
+	var names []string
+	for i := uint64(0); i < count; i++ {
+		var name []byte
+		var err error
+		if name, buf, err = readLengthPrefixed(buf); err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, string(name))
+	}
+
+	return names, buf, nil
+}
+
+func readEncryptionContext(buf []byte) (map[string]string, []byte, error) {
+	count, n := binary.Uvarint(buf)
+	// Every entry is at least two bytes
+	if n <= 0 || count > uint64(len(buf)-n)/2 {
+		return nil, nil, ErrorInvalidEnvelope
+	}
+	buf = buf[n:]
+
+	if count == 0 {
+		return nil, buf, nil
+	}
+
+	encryptionContext := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var key, value []byte
+		var err error
+		if key, buf, err = readLengthPrefixed(buf); err != nil {
+			return nil, nil, err
+		}
+
+		if value, buf, err = readLengthPrefixed(buf); err != nil {
+			return nil, nil, err
+		}
+
+		encryptionContext[string(key)] = string(value)
+	}
+
+	return encryptionContext, buf, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], x)
+	return append(buf, length[:n]...)
+}
+
+func appendLengthPrefixed(buf []byte, b []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(b))), b...)
+}
+
+func readLengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return nil, nil, ErrorInvalidEnvelope
+	}
+
+	end := n + int(length)
+	return buf[n:end], buf[end:], nil
+}
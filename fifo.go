@@ -0,0 +1,53 @@
+package kitsune
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+)
+
+// The name of a FIFO queue has to end with this suffix.
+const fifoQueueSuffix = ".fifo"
+
+// ErrorMessageGroupIDRequired is returned when sending to a FIFO queue without a message group id.
+var ErrorMessageGroupIDRequired = errors.New("message group id is required when sending to a FIFO queue")
+
+func isFIFOQueue(queueName *string) bool {
+	return strings.HasSuffix(*queueName, fifoQueueSuffix)
+}
+
+func validateFIFO(queueName *string, sendOpts *sendOptions) error {
+	if isFIFOQueue(queueName) && sendOpts.messageGroupID == "" {
+		return ErrorMessageGroupIDRequired
+	}
+
+	return nil
+}
+
+// contentDeduplicationID returns the hex encoded SHA-256 hash of the payload. The result is 64 characters which is within the
+// 128 character limit of a deduplication id.
+func contentDeduplicationID(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// MessageGroupIDOf returns the message group id of a message received from a FIFO queue. Returns an empty string if not set.
+func MessageGroupIDOf(message *sqs.Message) string {
+	return aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+}
+
+// SequenceNumberOf returns the sequence number of a message received from a FIFO queue. Returns an empty string if not set.
+func SequenceNumberOf(message *sqs.Message) string {
+	return aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSequenceNumber])
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
@@ -1,10 +1,19 @@
 module github.com/larwef/kitsune
 
+// klauspost/compress and andybalholm/brotli require Go 1.22
+go 1.22
+
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/aws/aws-lambda-go v1.10.0
 	github.com/aws/aws-sdk-go v1.15.81
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.1.0
+	github.com/klauspost/compress v1.18.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
 	golang.org/x/net v0.0.0-20181114220301-adae6a3d119a // indirect
@@ -0,0 +1,286 @@
+package kitsune
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A message can't be kept invisible for longer than 12 hours after it was received.
+const maxVisibilityPeriod = 12 * time.Hour
+
+var (
+	// ErrorReceiptHandleExpired is reported by a Heartbeat when the visibility of the message can't be extended because the
+	// receipt handle has expired. The message might already have been received by another consumer.
+	ErrorReceiptHandleExpired = errors.New("receipt handle has expired")
+
+	// ErrorMaxVisibilityReached is reported by a Heartbeat when the message has been invisible for the 12 hours allowed by SQS.
+	// The message becomes visible again when the last extension expires.
+	ErrorMaxVisibilityReached = errors.New("message has reached the maximum visibility period of 12 hours")
+
+	// ErrorInvalidHeartbeatInterval is reported by a Heartbeat which is not started because the visibility timeout is not
+	// positive, or the interval is not positive and shorter than the visibility timeout.
+	ErrorInvalidHeartbeatInterval = errors.New("heartbeat interval has to be positive and shorter than the visibility timeout")
+)
+
+// Heartbeat keeps extending the visibility of a message in the background while it is being processed. The heartbeat is stopped
+// when the message is deleted, backed off or has its visibility changed using the client, when Stop is called or when the
+// visibility can no longer be extended.
+type Heartbeat struct {
+	opts heartbeatOptions
+
+	client    *Client
+	queueName *string
+	message   *sqs.Message
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+type heartbeatOptions struct {
+	visibilityTimeout int64
+	interval          time.Duration
+	errorHandler      func(error)
+	receivedAt        time.Time
+}
+
+// HeartbeatOption sets configuration options for a Heartbeat.
+type HeartbeatOption func(*heartbeatOptions)
+
+// HeartbeatVisibilityTimeout sets the visibility timeout in seconds the message is extended by on every beat. Default is the
+// initial visibility timeout of the client.
+func HeartbeatVisibilityTimeout(timeout int64) HeartbeatOption {
+	return func(o *heartbeatOptions) { o.visibilityTimeout = timeout }
+}
+
+// HeartbeatInterval sets how often the visibility is extended. Has to be shorter than the visibility timeout. Default is half
+// the visibility timeout.
+func HeartbeatInterval(d time.Duration) HeartbeatOption {
+	return func(o *heartbeatOptions) { o.interval = d }
+}
+
+// HeartbeatReceivedAt sets when the message was received. The 12 hour limit of SQS is counted from when the message was received.
+// Default is when the heartbeat is started.
+func HeartbeatReceivedAt(t time.Time) HeartbeatOption {
+	return func(o *heartbeatOptions) { o.receivedAt = t }
+}
+
+// HeartbeatErrorHandler sets a function which is called with errors from extending the visibility. Failed extensions are retried
+// on the next beat, except when the error is ErrorReceiptHandleExpired or ErrorMaxVisibilityReached which stop the heartbeat.
+// The error handler must not stop the heartbeat. Default is to ignore errors.
+func HeartbeatErrorHandler(f func(error)) HeartbeatOption {
+	return func(o *heartbeatOptions) { o.errorHandler = f }
+}
+
+// StartHeartbeat starts extending the visibility of the message. Start the heartbeat right after receiving the message, or set
+// HeartbeatReceivedAt, since the 12 hour limit of SQS is counted from when the message was received.
+func (c *Client) StartHeartbeat(queueName *string, message *sqs.Message, opt ...HeartbeatOption) *Heartbeat {
+	return c.StartHeartbeatWithContext(aws.BackgroundContext(), queueName, message, opt...)
+}
+
+// StartHeartbeatWithContext is the same as StartHeartbeat with the addition of a context. The heartbeat stops when the context
+// is done. If the interval is not valid the heartbeat is returned stopped, with ErrorInvalidHeartbeatInterval reported by Err and
+// passed to the error handler.
+func (c *Client) StartHeartbeatWithContext(ctx aws.Context, queueName *string, message *sqs.Message, opt ...HeartbeatOption) *Heartbeat {
+	opts := heartbeatOptions{
+		visibilityTimeout: c.opts.initialVisibilityTimeout,
+		errorHandler:      func(error) {},
+		receivedAt:        time.Now(),
+	}
+
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	if opts.interval <= 0 {
+		opts.interval = time.Duration(opts.visibilityTimeout) * time.Second / 2
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	h := &Heartbeat{
+		opts:      opts,
+		client:    c,
+		queueName: queueName,
+		message:   message,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	if opts.visibilityTimeout <= 0 || opts.interval <= 0 || opts.interval >= time.Duration(opts.visibilityTimeout)*time.Second {
+		h.stop(ErrorInvalidHeartbeatInterval)
+		cancel()
+		close(h.done)
+		return h
+	}
+
+	c.heartbeats.put(message.ReceiptHandle, h)
+	go h.run(ctx)
+
+	return h
+}
+
+// Stop stops extending the visibility of the message. Waits for an ongoing extension to finish.
+func (h *Heartbeat) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// Done returns a channel which is closed when the heartbeat has stopped.
+func (h *Heartbeat) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns ErrorReceiptHandleExpired or ErrorMaxVisibilityReached if the heartbeat stopped because the visibility could no
+// longer be extended. Returns nil otherwise.
+func (h *Heartbeat) Err() error {
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+func (h *Heartbeat) run(ctx context.Context) {
+	defer close(h.done)
+	defer h.client.heartbeats.remove(h.message.ReceiptHandle, h)
+
+	ticker := time.NewTicker(h.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Never extend past the 12 hours allowed by SQS
+		timeout := h.opts.visibilityTimeout
+		remaining := int64((maxVisibilityPeriod - time.Since(h.opts.receivedAt)) / time.Second)
+		if remaining <= 0 {
+			h.stop(ErrorMaxVisibilityReached)
+			return
+		}
+
+		if remaining < timeout {
+			timeout = remaining
+		}
+
+		err := h.client.awsSQSClient.changeMessageVisibility(ctx, h.queueName, h.message, timeout)
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if err == nil {
+			// The last extension lasts until the limit is reached
+			if timeout == remaining {
+				h.stop(ErrorMaxVisibilityReached)
+				return
+			}
+
+			continue
+		}
+
+		if receiptHandleExpired(err) {
+			h.stop(ErrorReceiptHandleExpired)
+			return
+		}
+
+		h.opts.errorHandler(err)
+	}
+}
+
+// stop reports the reason the heartbeat stopped by itself.
+func (h *Heartbeat) stop(err error) {
+	h.err = err
+	h.opts.errorHandler(err)
+}
+
+// receiptHandleExpired returns true if the error from SQS is caused by an invalid or expired receipt handle.
+func receiptHandleExpired(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case sqs.ErrCodeReceiptHandleIsInvalid, sqs.ErrCodeMessageNotInflight:
+		return true
+	case "InvalidParameterValue":
+		return strings.Contains(aerr.Message(), "receipt handle has expired")
+	default:
+		return false
+	}
+}
+
+// heartbeatRegistry keeps track of the running heartbeats so they can be stopped when the message is deleted or backed off.
+// Entries are keyed by receipt handle.
+type heartbeatRegistry struct {
+	entries map[string]*Heartbeat
+	lock    sync.Mutex
+}
+
+func (r *heartbeatRegistry) put(receiptHandle *string, h *Heartbeat) {
+	if receiptHandle == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[string]*Heartbeat)
+	}
+
+	r.entries[*receiptHandle] = h
+}
+
+// remove removes the heartbeat from the registry unless it has been replaced by another heartbeat.
+func (r *heartbeatRegistry) remove(receiptHandle *string, h *Heartbeat) {
+	if receiptHandle == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.entries[*receiptHandle] == h {
+		delete(r.entries, *receiptHandle)
+	}
+}
+
+// stop stops the heartbeat of the message if one is running.
+func (r *heartbeatRegistry) stop(receiptHandle *string) {
+	if receiptHandle == nil {
+		return
+	}
+
+	r.lock.Lock()
+	h, exists := r.entries[*receiptHandle]
+	r.lock.Unlock()
+
+	if exists {
+		h.Stop()
+	}
+}
+
+// stopAll stops every running heartbeat.
+func (r *heartbeatRegistry) stopAll() {
+	r.lock.Lock()
+	heartbeats := make([]*Heartbeat, 0, len(r.entries))
+	for _, h := range r.entries {
+		heartbeats = append(heartbeats, h)
+	}
+	r.lock.Unlock()
+
+	for _, h := range heartbeats {
+		h.Stop()
+	}
+}
@@ -0,0 +1,300 @@
+package kitsune
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// NoKMSKeyCacheLimit disables a limit of the kms key cache.
+const NoKMSKeyCacheLimit = 0
+
+// KMSKeyCacheMaxEntries sets the maximum number of data keys in the kms key cache. The least recently used key is evicted when
+// the cache is full. Negative values are treated as NoKMSKeyCacheLimit. Default is 1000.
+func KMSKeyCacheMaxEntries(n int) ClientOption {
+	if n < 0 {
+		n = NoKMSKeyCacheLimit
+	}
+
+	return func(o *options) { o.kmsKeyCacheMaxEntries = n }
+}
+
+// KMSKeyCacheMaxMessages sets the maximum number of messages encrypted with a cached data key. A new data key is generated when
+// the limit is reached. Default is NoKMSKeyCacheLimit.
+func KMSKeyCacheMaxMessages(n int) ClientOption {
+	return func(o *options) { o.kmsKeyCacheMaxMessages = n }
+}
+
+// KMSKeyCacheMaxBytes sets the maximum number of bytes encrypted with a cached data key. A new data key is generated when the
+// limit would be exceeded. Default is NoKMSKeyCacheLimit.
+func KMSKeyCacheMaxBytes(n int64) ClientOption {
+	return func(o *options) { o.kmsKeyCacheMaxBytes = n }
+}
+
+// keyCache is a LRU cache of data keys. Entries expire after the expiration period and keys used for encryption are evicted when
+// they have encrypted the maximum number of messages or bytes. The plaintext of evicted keys is overwritten with zeros. The cache
+// owns the plaintext keys it holds, and returns copies which the caller should zero when done.
+type keyCache struct {
+	entries map[[16]byte]*cacheEntry
+	// Most recently used entry first
+	lru *list.List
+	// Oldest entry first. Every entry has the same expiration period, so entries expire in the order they were put
+	expiry *list.List
+
+	maxEntries       int
+	maxMessages      int
+	maxBytes         int64
+	expirationPeriod time.Duration
+	now              func() time.Time
+
+	lock    sync.Mutex
+	closed  bool
+	running bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// The janitor never runs more often than this, regardless of the expiration period.
+const minJanitorInterval = time.Second
+
+type cacheEntry struct {
+	key        [16]byte
+	keyID      string
+	plainText  []byte
+	cipherText []byte
+	entered    time.Time
+
+	// Usage of keys used for encryption
+	messages int
+	bytes    int64
+
+	lruElement    *list.Element
+	expiryElement *list.Element
+}
+
+// newKeyCache returns a cache which evicts expired entries in the background while it holds entries.
+func newKeyCache(opts *options) *keyCache {
+	kc := &keyCache{
+		entries:          make(map[[16]byte]*cacheEntry),
+		lru:              list.New(),
+		expiry:           list.New(),
+		maxEntries:       opts.kmsKeyCacheMaxEntries,
+		maxMessages:      opts.kmsKeyCacheMaxMessages,
+		maxBytes:         opts.kmsKeyCacheMaxBytes,
+		expirationPeriod: opts.kmsKeyCacheExpirationPeriod,
+		now:              time.Now,
+		done:             make(chan struct{}),
+	}
+
+	return kc
+}
+
+// startJanitor starts the janitor unless it is running. Must be called with the lock held.
+func (kc *keyCache) startJanitor() {
+	if kc.running || kc.closed || kc.expirationPeriod <= 0 {
+		return
+	}
+
+	interval := kc.expirationPeriod / 2
+	if interval < minJanitorInterval {
+		interval = minJanitorInterval
+	}
+
+	kc.running = true
+	kc.wg.Add(1)
+	go kc.janitor(interval)
+}
+
+// janitor evicts expired entries at the interval, so keys are zeroed even when the cache is not in use. Stops when the cache is
+// empty and is started again when an entry is added.
+func (kc *keyCache) janitor(interval time.Duration) {
+	defer kc.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			kc.lock.Lock()
+			kc.expire()
+			if len(kc.entries) == 0 {
+				kc.running = false
+				kc.lock.Unlock()
+				return
+			}
+			kc.lock.Unlock()
+		case <-kc.done:
+			return
+		}
+	}
+}
+
+// close stops the janitor and evicts every entry. Keys put after the cache is closed are not cached.
+func (kc *keyCache) close() {
+	kc.lock.Lock()
+	if kc.closed {
+		kc.lock.Unlock()
+		return
+	}
+
+	kc.closed = true
+	close(kc.done)
+	for _, entry := range kc.entries {
+		kc.remove(entry)
+	}
+	kc.lock.Unlock()
+
+	kc.wg.Wait()
+}
+
+// put adds a copy of a data key used for decryption to the cache.
+func (kc *keyCache) put(key [16]byte, keyID string, plainText []byte, cipherText []byte) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+
+	kc.add(&cacheEntry{key: key, keyID: keyID, plainText: clone(plainText), cipherText: cipherText})
+}
+
+// putUsed adds a copy of a data key which has encrypted a message of n bytes to the cache. The key is not cached if it can't
+// encrypt another message.
+func (kc *keyCache) putUsed(key [16]byte, keyID string, plainText []byte, cipherText []byte, n int) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+
+	entry := &cacheEntry{key: key, keyID: keyID, cipherText: cipherText, messages: 1, bytes: int64(n)}
+	if kc.exhausted(entry, 0) {
+		return
+	}
+
+	entry.plainText = clone(plainText)
+	kc.add(entry)
+}
+
+// get returns a copy of the data key if it exists and has not expired.
+func (kc *keyCache) get(key [16]byte) (cacheEntry, bool) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+
+	entry, exists := kc.lookup(key)
+	if !exists {
+		return cacheEntry{}, false
+	}
+
+	return entry.copy(), true
+}
+
+// use returns a copy of the data key if it exists, has not expired and can encrypt another message of n bytes within the limits.
+// The message is counted towards the limits of the key. A key which reaches a limit is evicted.
+func (kc *keyCache) use(key [16]byte, n int) (cacheEntry, bool) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+
+	entry, exists := kc.lookup(key)
+	if !exists {
+		return cacheEntry{}, false
+	}
+
+	if kc.exhausted(entry, n) {
+		kc.remove(entry)
+		return cacheEntry{}, false
+	}
+
+	entry.messages++
+	entry.bytes += int64(n)
+
+	used := entry.copy()
+	if kc.exhausted(entry, 0) {
+		kc.remove(entry)
+	}
+
+	return used, true
+}
+
+// exhausted returns true if encrypting another message of n bytes with the entry would exceed a limit.
+func (kc *keyCache) exhausted(entry *cacheEntry, n int) bool {
+	if kc.maxMessages != NoKMSKeyCacheLimit && entry.messages+1 > kc.maxMessages {
+		return true
+	}
+
+	return kc.maxBytes != NoKMSKeyCacheLimit && entry.bytes+int64(n) > kc.maxBytes
+}
+
+// lookup returns the entry and marks it as the most recently used. Expired entries are evicted first.
+func (kc *keyCache) lookup(key [16]byte) (*cacheEntry, bool) {
+	kc.expire()
+
+	entry, exists := kc.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	kc.lru.MoveToFront(entry.lruElement)
+	return entry, true
+}
+
+// add puts the entry in the cache, replacing any entry with the same key. The least recently used entry is evicted if the cache
+// is full.
+func (kc *keyCache) add(entry *cacheEntry) {
+	if kc.closed {
+		zero(entry.plainText)
+		return
+	}
+
+	kc.expire()
+
+	if existing, exists := kc.entries[entry.key]; exists {
+		kc.remove(existing)
+	}
+
+	if kc.maxEntries != NoKMSKeyCacheLimit {
+		for len(kc.entries) >= kc.maxEntries {
+			kc.remove(kc.lru.Back().Value.(*cacheEntry))
+		}
+	}
+
+	entry.entered = kc.now()
+	entry.lruElement = kc.lru.PushFront(entry)
+	entry.expiryElement = kc.expiry.PushBack(entry)
+	kc.entries[entry.key] = entry
+	kc.startJanitor()
+}
+
+// expire evicts expired entries. Only the entries which have expired are visited.
+func (kc *keyCache) expire() {
+	now := kc.now()
+	for element := kc.expiry.Front(); element != nil; element = kc.expiry.Front() {
+		entry := element.Value.(*cacheEntry)
+		if !entry.entered.Add(kc.expirationPeriod).Before(now) {
+			return
+		}
+
+		kc.remove(entry)
+	}
+}
+
+// remove evicts the entry and overwrites the plaintext key with zeros.
+func (kc *keyCache) remove(entry *cacheEntry) {
+	kc.lru.Remove(entry.lruElement)
+	kc.expiry.Remove(entry.expiryElement)
+	delete(kc.entries, entry.key)
+	zero(entry.plainText)
+}
+
+// copy returns a copy of the entry holding a copy of the plaintext key, which is not affected when the entry is evicted.
+func (entry *cacheEntry) copy() cacheEntry {
+	c := *entry
+	c.plainText = clone(entry.plainText)
+	return c
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// zero overwrites the key with zeros.
+func zero(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,178 @@
+package kitsune
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// KeyProvider generates and decrypts the data keys used to encrypt payloads. The client takes ownership of returned plaintext
+// keys and overwrites them with zeros when done, so a provider has to return a new slice on every call.
+type KeyProvider interface {
+	// GenerateDataKey returns a new data key of the key spec, eg. AES_256, protected by the key with the id. The encryption
+	// context has to be bound to the encrypted data key, so it can only be decrypted with the same encryption context.
+	GenerateDataKey(ctx aws.Context, keyID string, keySpec string, encryptionContext map[string]string) (*DataKey, error)
+
+	// Decrypt returns the plaintext of a data key generated by GenerateDataKey. The key id is the KeyID of the data key.
+	Decrypt(ctx aws.Context, keyID string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// DataKey is a data key generated by a KeyProvider.
+type DataKey struct {
+	// KeyID identifies the key protecting the data key, eg. the ARN of a KMS key. It is put in the envelope of encrypted
+	// payloads and passed to Decrypt by the receiver.
+	KeyID        string
+	Plaintext    []byte
+	EncryptedKey []byte
+}
+
+// EncryptionKeyProvider sets the provider of data keys. The key set by KMSKeyID, KMSFailoverKeyIDs and MessageKMSKeyID is the
+// id of a key in the provider. Default is a KMSKeyProvider using the session of the client.
+func EncryptionKeyProvider(p KeyProvider) ClientOption {
+	return func(o *options) { o.keyProvider = p }
+}
+
+var (
+	// ErrorKeyNotFound is returned by StaticKeyring when a key is not in the keyring.
+	ErrorKeyNotFound = errors.New("key not found in keyring")
+
+	// ErrorInvalidKey is returned by StaticKeyring when a key is not a 128 or 256 bit AES key.
+	ErrorInvalidKey = errors.New("invalid key. Has to be 16 or 32 bytes")
+)
+
+// StaticKeyring is a KeyProvider protecting data keys with static AES keys held in memory. Intended for local development and
+// on-premise environments without KMS.
+type StaticKeyring struct {
+	keys map[string][]byte
+}
+
+// NewStaticKeyring returns a keyring with the keys by id. Keys have to be 16 or 32 bytes.
+func NewStaticKeyring(keys map[string][]byte) (*StaticKeyring, error) {
+	kr := &StaticKeyring{keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		if _, err := keyringAlgorithm(key); err != nil {
+			return nil, err
+		}
+
+		kr.keys[id] = clone(key)
+	}
+
+	return kr, nil
+}
+
+// LoadStaticKeyring returns a keyring with the keys in the file. The file is a JSON object with base64 encoded keys by id, eg.
+// {"myKey": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}.
+func LoadStaticKeyring(path string) (*StaticKeyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStaticKeyring(b)
+}
+
+// StaticKeyringFromEnv returns a keyring with the keys in the environment variable. The format is the same as for
+// LoadStaticKeyring.
+func StaticKeyringFromEnv(name string) (*StaticKeyring, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return nil, errors.New("environment variable " + name + " is not set")
+	}
+
+	return parseStaticKeyring([]byte(value))
+}
+
+func parseStaticKeyring(b []byte) (*StaticKeyring, error) {
+	var encoded map[string]string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[id] = key
+	}
+
+	return NewStaticKeyring(keys)
+}
+
+// GenerateDataKey generates a random data key and encrypts it with the key with the id. The encryption context is bound to the
+// encrypted data key as additional authenticated data.
+func (kr *StaticKeyring) GenerateDataKey(ctx aws.Context, keyID string, keySpec string, encryptionContext map[string]string) (*DataKey, error) {
+	key, exists := kr.keys[keyID]
+	if !exists {
+		return nil, ErrorKeyNotFound
+	}
+
+	size, err := keySpecSize(keySpec)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, err
+	}
+
+	algorithm, _ := keyringAlgorithm(key)
+	nonce, ciphertext, err := sealData(algorithm, plaintext, key, encryptionContextAAD(encryptionContext))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyID:        keyID,
+		Plaintext:    plaintext,
+		EncryptedKey: append(nonce, ciphertext...),
+	}, nil
+}
+
+// Decrypt decrypts the data key with the key with the id.
+func (kr *StaticKeyring) Decrypt(ctx aws.Context, keyID string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	key, exists := kr.keys[keyID]
+	if !exists {
+		return nil, ErrorKeyNotFound
+	}
+
+	// AES-GCM uses a 12 byte nonce
+	const nonceSize = 12
+	if len(encryptedKey) < nonceSize {
+		return nil, &TamperError{Reason: "encrypted data key is too short"}
+	}
+
+	algorithm, _ := keyringAlgorithm(key)
+	return openData(algorithm, encryptedKey[:nonceSize], encryptedKey[nonceSize:], key, encryptionContextAAD(encryptionContext))
+}
+
+// keyringAlgorithm returns the algorithm used to encrypt data keys with the key.
+func keyringAlgorithm(key []byte) (Algorithm, error) {
+	switch len(key) {
+	case algorithms[AlgorithmAES256GCM].keySize:
+		return AlgorithmAES256GCM, nil
+	case algorithms[AlgorithmAES128GCM].keySize:
+		return AlgorithmAES128GCM, nil
+	default:
+		return "", ErrorInvalidKey
+	}
+}
+
+// keySpecSize returns the size in bytes of keys of the key spec.
+func keySpecSize(keySpec string) (int, error) {
+	for _, spec := range algorithms {
+		if spec.keySpec == keySpec {
+			return spec.keySize, nil
+		}
+	}
+
+	return 0, ErrorUnsupportedAlgorithm
+}
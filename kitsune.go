@@ -1,19 +1,13 @@
 package kitsune
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"io/ioutil"
 	"math"
 	"strconv"
 	"time"
@@ -29,8 +23,14 @@ const (
 
 	// AttributeCompression is used to signal that the payload is compressed
 	AttributeCompression = "compression"
+
+	// AttributeNameEncoding is used to signal that the payload is binary and how it is encoded in the message body.
+	AttributeNameEncoding = "encoding"
 )
 
+// ErrorBackoffFunctionNotSet is returned by Backoff when no backoff function is configured on the client.
+var ErrorBackoffFunctionNotSet = errors.New("no backoff function configured")
+
 // Client object handles communication with SQS
 type Client struct {
 	opts options
@@ -40,6 +40,10 @@ type Client struct {
 	awsSQSClient *sqsClient
 	awsS3Client  *s3Client
 	awsKMSClient *kmsClient
+
+	payloads   payloadRegistry
+	heartbeats heartbeatRegistry
+	deletes    deleteBuffers
 }
 
 type options struct {
@@ -55,10 +59,33 @@ type options struct {
 	s3Bucket                    string
 	forceS3                     bool
 	kmsKeyID                    string
+	kmsFailoverKeyIDs           []string
+	keyProvider                 KeyProvider
 	compressionEnabled          bool
+	compressionAlgorithm        CompressionAlgorithm
+	compressionLevel            int
+	compressionLevels           map[CompressionAlgorithm]int
+	compressionEnabledSet       bool
+	maxDecompressedSize         int64
+	compressionThreshold        int
+	encoding                    Encoding
+	encryptionContext           map[string]string
+	encryptionContextFunc       func(string) map[string]string
+	authenticatedEnvelope       bool
+	authenticatedAttributes     []string
+	encryptionAlgorithm         Algorithm
+	envelopeVersion             int
 	kmsKeyCacheEnabled          bool
 	kmsKeyCacheExpirationPeriod time.Duration
+	kmsKeyCacheMaxEntries       int
+	kmsKeyCacheMaxMessages      int
+	kmsKeyCacheMaxBytes         int64
 	skipSQSClient               bool
+	s3PointerFormat             PointerFormat
+	deleteS3Payloads            bool
+	deleteBufferLinger          time.Duration
+	pipeline                    []pipelineStage
+	pipelineErr                 error
 }
 
 var defaultClientOptions = options{
@@ -68,13 +95,27 @@ var defaultClientOptions = options{
 	backoffFactor:               2,
 	maxVisibilityTimeout:        900,
 	waitTimeSeconds:             20,
-	attributeNames:              []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
-	messageAttributeNames:       []*string{aws.String(AttributeNameS3Bucket), aws.String(AttributeNameKMSKey), aws.String(AttributeCompression)},
+	attributeNames:              []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount), aws.String(sqs.MessageSystemAttributeNameMessageGroupId), aws.String(sqs.MessageSystemAttributeNameSequenceNumber)},
+	messageAttributeNames:       []*string{aws.String(AttributeNameS3Bucket), aws.String(AttributeNameKMSKey), aws.String(AttributeCompression), aws.String(AttributeNameEncoding), aws.String(AttributeNameExtendedPayloadSize), aws.String(AttributeNameLegacyPayloadSize), aws.String(AttributeNamePipeline)},
 	forceS3:                     false,
 	compressionEnabled:          false,
+	compressionAlgorithm:        CompressionGzip,
+	compressionLevel:            DefaultCompressionLevel,
+	maxDecompressedSize:         DefaultMaxDecompressedSize,
+	compressionThreshold:        NoCompressionThreshold,
+	encoding:                    EncodingLegacy,
+	encryptionAlgorithm:         AlgorithmAES256GCM,
+	envelopeVersion:             EnvelopeVersionLegacy,
 	kmsKeyCacheEnabled:          false,
 	kmsKeyCacheExpirationPeriod: 5 * time.Minute,
+	kmsKeyCacheMaxEntries:       1000,
+	kmsKeyCacheMaxMessages:      NoKMSKeyCacheLimit,
+	kmsKeyCacheMaxBytes:         NoKMSKeyCacheLimit,
 	skipSQSClient:               false,
+	s3PointerFormat:             PointerFormatKitsune,
+	deleteS3Payloads:            false,
+	deleteBufferLinger:          0,
+	pipeline:                    NewPipeline().Compression().Encryption().stages,
 }
 
 // ClientOption sets configuration options for a awsSQSClient.
@@ -118,7 +159,7 @@ func WaitTimeSeconds(w int64) ClientOption {
 }
 
 // AttributeNames sets the attributes to be returned when fetching messages. ApproximateReceiveCount is always returned because it
-// is used when calculating backoff.
+// is used when calculating backoff. MessageGroupId and SequenceNumber are always returned for messages from FIFO queues.
 func AttributeNames(s ...string) ClientOption {
 	return func(o *options) {
 		for i := range s {
@@ -147,18 +188,24 @@ func ForceS3(b bool) ClientOption {
 	return func(o *options) { o.forceS3 = b }
 }
 
-// KMSKeyID sets the KMS key to be used for encryption.
+// KMSKeyID sets the KMS key to be used for encryption. When using another EncryptionKeyProvider it is the id of a key in the
+// provider.
 func KMSKeyID(s string) ClientOption {
 	return func(o *options) { o.kmsKeyID = s }
 }
 
-// CompressionEnabled is used to enable or disable compression of payload.
+// CompressionEnabled is used to enable or disable compression of payload. The algorithm is gzip unless set with Compression.
+// Takes precedence over Compression and CompressionThreshold, which enable compression when CompressionEnabled is not set.
 func CompressionEnabled(b bool) ClientOption {
-	return func(o *options) { o.compressionEnabled = b }
+	return func(o *options) {
+		o.compressionEnabled = b
+		o.compressionEnabledSet = true
+	}
 }
 
 // KMSKeyCacheEnabled used to enable or disable kms key caching. Note that caching is against best practise, but might provide
-// significant savings by reducing calls to KMS.
+// significant savings by reducing calls to KMS. While keys are cached a background goroutine evicts expired keys and overwrites
+// them with zeros. It stops when the cache is empty, or when the client is closed with Close.
 func KMSKeyCacheEnabled(b bool) ClientOption {
 	return func(o *options) { o.kmsKeyCacheEnabled = b }
 }
@@ -174,14 +221,134 @@ func SkipSQSClient(b bool) ClientOption {
 	return func(o *options) { o.skipSQSClient = b }
 }
 
+// SendResult holds information about a message sent to a queue. S3Bucket and S3Key are set if the payload was uploaded to S3 and
+// KMSKeyID is set if the payload was encrypted.
+type SendResult struct {
+	MessageID        string
+	MD5OfMessageBody string
+	SequenceNumber   string
+	S3Bucket         string
+	S3Key            string
+	KMSKeyID         string
+}
+
+type sendOptions struct {
+	delaySeconds           int64
+	forceS3                bool
+	compressionEnabled     bool
+	compressionAlgorithm   CompressionAlgorithm
+	kmsKeyID               string
+	kmsFailoverKeyIDs      []string
+	s3PointerFormat        PointerFormat
+	messageGroupID         string
+	messageDeduplicationID string
+	contentDeduplication   bool
+	encryptionContext      map[string]string
+}
+
+// SendOption sets options for a single message when sending. Options not set defaults to the ones configured on the client.
+type SendOption func(*sendOptions)
+
+// MessageDelaySeconds overrides the delay configured on the client for a single message. Not used for FIFO queues.
+func MessageDelaySeconds(d int64) SendOption {
+	return func(o *sendOptions) { o.delaySeconds = d }
+}
+
+// MessageForceS3 overrides if a single message should be saved to S3 regardless of size. A bucket has to be configured on the
+// client.
+func MessageForceS3(b bool) SendOption {
+	return func(o *sendOptions) { o.forceS3 = b }
+}
+
+// MessageCompressionEnabled overrides if the payload of a single message should be compressed.
+func MessageCompressionEnabled(b bool) SendOption {
+	return func(o *sendOptions) { o.compressionEnabled = b }
+}
+
+// MessageKMSKeyID overrides the KMS key used to encrypt a single message. The failover keys configured on the client are not
+// used for the message. Set to an empty string to send the message unencrypted.
+func MessageKMSKeyID(s string) SendOption {
+	return func(o *sendOptions) {
+		o.kmsKeyID = s
+		o.kmsFailoverKeyIDs = nil
+	}
+}
+
+// MessageS3PointerFormat overrides the format used to point to the payload of a single message if it is uploaded to S3.
+func MessageS3PointerFormat(f PointerFormat) SendOption {
+	return func(o *sendOptions) { o.s3PointerFormat = f }
+}
+
+// MessageGroupID sets the message group id. Required when sending to a FIFO queue. Messages with the same group id are delivered
+// in the order they were sent.
+func MessageGroupID(id string) SendOption {
+	return func(o *sendOptions) { o.messageGroupID = id }
+}
+
+// MessageDeduplicationID sets the token SQS uses to deduplicate messages sent to a FIFO queue.
+func MessageDeduplicationID(id string) SendOption {
+	return func(o *sendOptions) { o.messageDeduplicationID = id }
+}
+
+// ContentDeduplication derives the deduplication id from a hash of the payload if no deduplication id is set. The hash is
+// computed before the payload is compressed and encrypted, so equal payloads get the same id even though the message bodies
+// differ.
+func ContentDeduplication(b bool) SendOption {
+	return func(o *sendOptions) { o.contentDeduplication = b }
+}
+
+// newSendOptions returns the options for sending a single message. Defaults are taken from the client options.
+func (c *Client) newSendOptions(queueName *string, payload []byte, opt []SendOption) sendOptions {
+	opts := sendOptions{
+		delaySeconds:         c.opts.delaySeconds,
+		forceS3:              c.opts.forceS3,
+		compressionEnabled:   c.opts.compressionEnabled,
+		compressionAlgorithm: c.opts.compressionAlgorithm,
+		kmsKeyID:             c.opts.kmsKeyID,
+		kmsFailoverKeyIDs:    c.opts.kmsFailoverKeyIDs,
+		s3PointerFormat:      c.opts.s3PointerFormat,
+	}
+
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	opts.encryptionContext = mergeEncryptionContexts(c.expectedEncryptionContext(*queueName), opts.encryptionContext)
+
+	if opts.contentDeduplication && opts.messageDeduplicationID == "" {
+		opts.messageDeduplicationID = contentDeduplicationID(payload)
+	}
+
+	return opts
+}
+
+// S3PointerFormat sets the format used to point to payloads uploaded to S3. Use PointerFormatJava when the receiver uses the
+// Java Extended Client Library. The format is detected automatically when receiving.
+func S3PointerFormat(f PointerFormat) ClientOption {
+	return func(o *options) { o.s3PointerFormat = f }
+}
+
+// DeleteS3Payloads enables deletion of payloads in S3. The client remembers where the payload of each received message is located
+// and deletes the object from S3 when the message is successfully deleted from the queue. Use DeletePayload to delete the
+// payload explicitly when messages are deleted by other means. Messages with payloads in other buckets than the one set with
+// S3Bucket are rejected with ErrorS3BucketNotAllowed. The location is forgotten when the message is backed off or made visible
+// with ChangeMessageVisibilityBatch and a timeout of 0, and after 12 hours if the message is never deleted.
+func DeleteS3Payloads(b bool) ClientOption {
+	return func(o *options) { o.deleteS3Payloads = b }
+}
+
 // New returns a new awsSQSClient with configuration set as defined by the ClientOptions. Will create a s3Client from the
-// aws.Config if a bucket is set. Same goes for KMS.
+// aws.Config if a bucket is set.
 func New(awsSession *session.Session, opt ...ClientOption) (*Client, error) {
 	opts := defaultClientOptions
 	for _, o := range opt {
 		o(&opts)
 	}
 
+	if opts.pipelineErr != nil {
+		return nil, opts.pipelineErr
+	}
+
 	var sqsc *sqsClient
 	if !opts.skipSQSClient {
 		sqsc = newSQSClient(sqs.New(awsSession), &opts)
@@ -192,10 +359,12 @@ func New(awsSession *session.Session, opt ...ClientOption) (*Client, error) {
 		s3c = newS3Client(s3.New(awsSession))
 	}
 
-	var kmsc *kmsClient
-	if opts.kmsKeyID != "" {
-		kmsc = newKMSClient(kms.New(awsSession), &opts)
+	// The KMS client is always created since the key can be set per message
+	provider := opts.keyProvider
+	if provider == nil {
+		provider = NewKMSKeyProvider(awsSession)
 	}
+	kmsc := newKMSClient(provider, &opts)
 
 	return &Client{
 		opts:         opts,
@@ -205,254 +374,360 @@ func New(awsSession *session.Session, opt ...ClientOption) (*Client, error) {
 	}, nil
 }
 
+// Close empties the kms key cache, overwriting the cached keys with zeros, flushes buffered deletes, stops running heartbeats and
+// stops the background goroutines of the client. Keys are no longer cached and deletes are no longer buffered after the client
+// is closed. Always returns nil.
+func (c *Client) Close() error {
+	c.heartbeats.stopAll()
+	c.deletes.close()
+
+	if c.awsKMSClient != nil {
+		c.awsKMSClient.close()
+	}
+
+	return nil
+}
+
 // SendMessage sends a message to the specified queue. Convenient method for sending a message without custom attributes. This
 // does not guarantee there will be no attributes on the message to SQS. The client might add attributes eg. for file events when
 // the payload is uploaded to S3.
-func (c *Client) SendMessage(queueName *string, payload []byte) error {
-	return c.SendMessageWithAttributes(queueName, payload, nil)
+func (c *Client) SendMessage(queueName *string, payload []byte, opt ...SendOption) (*SendResult, error) {
+	return c.SendMessageWithContext(aws.BackgroundContext(), queueName, payload, opt...)
+}
+
+// SendMessageWithContext is the same as SendMessage with the addition of a context. The context is passed on to every call to
+// SQS, S3 and KMS.
+func (c *Client) SendMessageWithContext(ctx aws.Context, queueName *string, payload []byte, opt ...SendOption) (*SendResult, error) {
+	return c.SendMessageWithAttributesWithContext(ctx, queueName, payload, nil, opt...)
 }
 
 // SendMessageWithAttributes sends a message to the specified queue with attributes. If the message size exceeds maximum, the
 // payload will be uploaded to the configured S3 bucket and a file event will be sent on the SQS queue. The bucket where the
 // message was uploaded if put on the message attributes. This means an no of attributes error can be thrown even though this
-// function is called with less than maximum number of attributes.
-func (c *Client) SendMessageWithAttributes(queueName *string, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue) error {
-	payld := payload
-	var err error
-
-	// Compress payload if compression is enabled
-	if c.opts.compressionEnabled {
-		payld, err = compressData(payld)
-		if err != nil {
-			return err
-		}
+// function is called with less than maximum number of attributes. When sending to a FIFO queue a message group id must be set
+// using the MessageGroupID SendOption. The delay configured on the client is not used for FIFO queues.
+func (c *Client) SendMessageWithAttributes(queueName *string, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, opt ...SendOption) (*SendResult, error) {
+	return c.SendMessageWithAttributesWithContext(aws.BackgroundContext(), queueName, payload, messageAttributes, opt...)
+}
 
-		if messageAttributes == nil {
-			messageAttributes = make(map[string]*sqs.MessageAttributeValue)
-		}
+// SendMessageWithAttributesWithContext is the same as SendMessageWithAttributes with the addition of a context. The context is
+// passed on to every call to SQS, S3 and KMS.
+func (c *Client) SendMessageWithAttributesWithContext(ctx aws.Context, queueName *string, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, opt ...SendOption) (*SendResult, error) {
+	sendOpts := c.newSendOptions(queueName, payload, opt)
+	if err := validateFIFO(queueName, &sendOpts); err != nil {
+		return nil, err
+	}
 
-		messageAttributes[AttributeCompression] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("gzip")}
+	result := &SendResult{}
+	payld, messageAttributes, err := c.prepareMessage(ctx, payload, messageAttributes, &sendOpts, result)
+	if err != nil {
+		return nil, err
 	}
 
-	// Encrypt the payload if a KMS key is configured
-	if c.opts.kmsKeyID != "" {
-		payld, err = c.encrypt(payld)
-		if err != nil {
-			return err
-		}
+	smo, err := c.awsSQSClient.sendMessage(ctx, queueName, payld, messageAttributes, &sendOpts)
+	if err != nil {
+		c.deleteUnsentPayload(result)
+		return nil, err
+	}
 
-		if messageAttributes == nil {
-			messageAttributes = make(map[string]*sqs.MessageAttributeValue)
+	result.MessageID = aws.StringValue(smo.MessageId)
+	result.MD5OfMessageBody = aws.StringValue(smo.MD5OfMessageBody)
+	result.SequenceNumber = aws.StringValue(smo.SequenceNumber)
+
+	return result, nil
+}
+
+// prepareMessage runs the payload through the pipeline and upload to S3 as configured by the send options. Returns
+// the payload to be put on the queue together with the message attributes needed by the receiver to unpack it. The KMS key and
+// S3 location used is set on the result.
+func (c *Client) prepareMessage(ctx aws.Context, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, sendOpts *sendOptions, result *SendResult) ([]byte, map[string]*sqs.MessageAttributeValue, error) {
+	// Validate the attributes set by the caller before anything is uploaded or encrypted
+	if err := validateAttributes(messageAttributes); err != nil {
+		return nil, nil, err
+	}
+
+	payld, messageAttributes, binary, err := c.encode(ctx, payload, messageAttributes, sendOpts, result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A binary payload is encoded once. If it ends up in S3 the raw bytes are uploaded instead.
+	raw := payld
+	if binary {
+		payld, err = encodeBody(raw, c.opts.encoding)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		messageAttributes[AttributeNameKMSKey] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: &c.opts.kmsKeyID}
+		messageAttributes[AttributeNameEncoding] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(string(c.opts.encoding))}
 	}
 
 	// Put payload to S3 if S3 is forced of message is larger than max size. Bucket needs to be configured.
-	if (c.opts.forceS3 || size(payld, messageAttributes) > maxMessageSize) && c.opts.s3Bucket != "" {
-		payld, err = c.uploadToS3(payld)
+	if (sendOpts.forceS3 || size(payld, messageAttributes) > maxMessageSize) && c.opts.s3Bucket != "" {
+		if binary {
+			payld = raw
+			messageAttributes[AttributeNameEncoding].StringValue = aws.String(encodingBinary)
+		}
+
+		var fe *fileEvent
+		payld, fe, err = c.uploadToS3(ctx, payld, sendOpts.s3PointerFormat)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
+		result.S3Bucket = aws.StringValue(fe.Bucket)
+		result.S3Key = aws.StringValue(fe.Filename)
+
 		if messageAttributes == nil {
 			messageAttributes = make(map[string]*sqs.MessageAttributeValue)
 		}
 
-		messageAttributes[AttributeNameS3Bucket] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: &c.opts.s3Bucket}
+		if sendOpts.s3PointerFormat == PointerFormatJava {
+			messageAttributes[AttributeNameExtendedPayloadSize] = &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(strconv.FormatInt(*fe.Size, 10))}
+		} else {
+			messageAttributes[AttributeNameS3Bucket] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: &c.opts.s3Bucket}
+		}
 	}
 
-	return c.awsSQSClient.sendMessage(queueName, payld, messageAttributes)
+	return payld, messageAttributes, nil
 }
 
-// The compressed string is base64 encoded because the compressed data might contain characters that are invalid and SQS would
-// throw an error
-func compressData(payload []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	zw := gzip.NewWriter(&buf)
+// deleteUnsentPayload deletes the payload uploaded to S3 for a message which was not put on the queue. The error is ignored since
+// the caller gets the error from sending the message.
+func (c *Client) deleteUnsentPayload(result *SendResult) {
+	if result.S3Key == "" {
+		return
+	}
 
-	if _, err := zw.Write(payload); err != nil {
-		return nil, err
+	fe := &fileEvent{
+		Bucket:   aws.String(result.S3Bucket),
+		Filename: aws.String(result.S3Key),
 	}
+	c.awsS3Client.deleteObject(aws.BackgroundContext(), fe)
+}
 
-	if err := zw.Close(); err != nil {
-		return nil, err
+// encrypt returns the encrypted event as bytes and the id of the KMS key used to encrypt the data key. The event is marshalled
+// as a binary envelope if binary is true and as JSON otherwise. With authenticated envelopes enabled the payload is bound to the
+// attributes looked up by attribute.
+func (c *Client) encrypt(ctx aws.Context, payload []byte, sendOpts *sendOptions, attribute func(string) (string, bool), binary bool) ([]byte, string, string, error) {
+	encryptedEvent := c.newEncryptedEvent(binary)
+	encryptedEvent.EncryptionContext = sendOpts.encryptionContext
+	encryptedEvent.Authenticated = c.opts.authenticatedEnvelope
+
+	if c.opts.authenticatedEnvelope {
+		encryptedEvent.AuthenticatedAttributes = c.authenticatedAttributeNames()
 	}
 
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(buf.Bytes())))
-	base64.StdEncoding.Encode(encoded, buf.Bytes())
-	return encoded, nil
-}
+	keyIDs := append([]string{sendOpts.kmsKeyID}, sendOpts.kmsFailoverKeyIDs...)
+	keyID, err := c.awsKMSClient.encrypt(ctx, keyIDs, payload, encryptedEvent, attribute)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error encrypting payload: %v", err)
+	}
 
-func (c *Client) encrypt(payload []byte) ([]byte, error) {
-	encryptedEvent, err := c.awsKMSClient.encrypt(&c.opts.kmsKeyID, payload)
+	encryptedEventBytes, err := marshalEnvelope(encryptedEvent, binary)
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting payload: %v", err)
+		return nil, "", "", err
 	}
 
-	encryptedEventBytes, err := json.Marshal(encryptedEvent)
+	return encryptedEventBytes, keyID, encryptedEvent.KeyID, nil
+}
+
+// decrypt unmarshals the encrypted event and returns the decrypted payload. The encryption context of the event has to contain
+// the encryption context configured for the queue the message was received from. If the event is authenticated the attributes
+// it is bound to are looked up using attribute.
+func (c *Client) decrypt(ctx aws.Context, queueName string, payload []byte, attribute func(string) (string, bool), binary bool) ([]byte, error) {
+	ee, err := unmarshalEnvelope(payload, binary)
 	if err != nil {
 		return nil, err
 	}
 
-	return encryptedEventBytes, nil
+	if _, exists := algorithms[ee.algorithm()]; !exists {
+		return nil, ErrorUnsupportedAlgorithm
+	}
+
+	if c.opts.authenticatedEnvelope && !ee.Authenticated {
+		return nil, &TamperError{Reason: "encrypted payload is not authenticated"}
+	}
+
+	if err := verifyEncryptionContext(c.expectedEncryptionContext(queueName), ee.EncryptionContext); err != nil {
+		return nil, err
+	}
+
+	return c.awsKMSClient.decrypt(ctx, ee, attribute)
 }
 
-func (c *Client) uploadToS3(payload []byte) ([]byte, error) {
-	fileEvent, err := c.awsS3Client.putObject(&c.opts.s3Bucket, payload)
+// uploadToS3 returns the pointer to the uploaded payload as bytes together with the file event describing the upload.
+func (c *Client) uploadToS3(ctx aws.Context, payload []byte, format PointerFormat) ([]byte, *fileEvent, error) {
+	fileEvent, err := c.awsS3Client.putObject(ctx, &c.opts.s3Bucket, payload)
 	if err != nil {
-		return nil, fmt.Errorf("error putting object to S3: %v", err)
+		return nil, nil, fmt.Errorf("error putting object to S3: %v", err)
 	}
 
-	fileEventBytes, err := json.Marshal(&fileEvent)
+	fileEventBytes, err := marshalPointer(fileEvent, format)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return fileEventBytes, err
+	return fileEventBytes, fileEvent, err
 }
 
 // ReceiveMessages polls the specified queue and returns the fetched messages. If the S3 bucket attribute is set, the payload is
-// fetched and replaces the file event in the sqs.Message body. This will not delete the object in S3. A lifecycle rule is
-// recommended.
+// fetched and replaces the file event in the sqs.Message body. The object in S3 is not deleted unless DeleteS3Payloads is
+// enabled. Otherwise a lifecycle rule is recommended.
 func (c *Client) ReceiveMessages(queueName *string) ([]*sqs.Message, error) {
-	messages, err := c.awsSQSClient.receiveMessage(queueName)
+	return c.ReceiveMessagesWithContext(aws.BackgroundContext(), queueName)
+}
+
+// ReceiveMessagesWithContext is the same as ReceiveMessages with the addition of a context. The context is passed on to every
+// call to SQS, S3 and KMS. Cancelling the context will abort an ongoing long poll.
+func (c *Client) ReceiveMessagesWithContext(ctx aws.Context, queueName *string) ([]*sqs.Message, error) {
+	messages, err := c.awsSQSClient.receiveMessage(ctx, queueName, c.opts.maxNumberOfMessages)
 	if err != nil {
 		return nil, err
 	}
 
-	// Loop through messages and check if payload is located in S3 and/or if its encrypted.
+	// Loop through messages and unpack payloads which are located in S3, encrypted or otherwise encoded.
 	for _, message := range messages {
-		// If S3 bucket is included the payload is located in S3 an needs to be fetched
-		if _, exists := message.MessageAttributes[AttributeNameS3Bucket]; exists && c.awsS3Client != nil {
-			var fe fileEvent
-			if err := json.Unmarshal([]byte(*message.Body), &fe); err != nil {
-				return nil, err
+		if err := c.decodeMessage(ctx, queueName, message); err != nil {
+			// None of the messages are returned, so there is no need to remember their payloads
+			for _, message := range messages {
+				c.payloads.take(message.ReceiptHandle)
 			}
 
-			if payload, err := c.awsS3Client.getObject(&fe); err == nil {
-				message.Body = aws.String(string(payload))
-				delete(message.MessageAttributes, AttributeNameS3Bucket)
-			} else {
-				return nil, err
-			}
+			return nil, err
 		}
+	}
 
-		// If KMS key is included the payload is encrypted and needs to be decrypted
-		if _, exists := message.MessageAttributes[AttributeNameKMSKey]; exists && c.awsKMSClient != nil {
-			var ee encryptedEvent
-			if err := json.Unmarshal([]byte(*message.Body), &ee); err != nil {
-				return nil, err
-			}
+	return messages, nil
+}
 
-			if decrypted, err := c.awsKMSClient.decrypt(&ee); err == nil {
-				decryptedStr := string(decrypted)
-				message.Body = &decryptedStr
-				delete(message.MessageAttributes, AttributeNameKMSKey)
-			} else {
-				return nil, err
-			}
+// failedMessage is a received message which could not be unpacked.
+type failedMessage struct {
+	message *sqs.Message
+	err     error
+}
+
+// receiveMessages receives up to maxNumberOfMessages messages and unpacks their payloads. Messages which can't be unpacked are
+// returned separately with the error, so one bad message doesn't keep the others from being handled.
+func (c *Client) receiveMessages(ctx aws.Context, queueName *string, maxNumberOfMessages int64) ([]*sqs.Message, []failedMessage, error) {
+	messages, err := c.awsSQSClient.receiveMessage(ctx, queueName, maxNumberOfMessages)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var decoded []*sqs.Message
+	var failed []failedMessage
+	for _, message := range messages {
+		if err := c.decodeMessage(ctx, queueName, message); err != nil {
+			failed = append(failed, failedMessage{message: message, err: err})
+			continue
 		}
 
-		// If compression key is included the payload needs to be decompressed
-		if _, exists := message.MessageAttributes[AttributeCompression]; exists {
-			buf := []byte(*message.Body)
-			if decompressed, err := decompressData(buf); err == nil {
-				message.Body = aws.String(string(decompressed))
-				delete(message.MessageAttributes, AttributeCompression)
-			} else {
-				return nil, err
-			}
+		decoded = append(decoded, message)
+	}
+
+	return decoded, failed, nil
+}
+
+// decodeMessage unpacks the payload of the message in place.
+func (c *Client) decodeMessage(ctx aws.Context, queueName *string, message *sqs.Message) error {
+	attribute := func(name string) (string, bool) {
+		value, exists := message.MessageAttributes[name]
+		if !exists {
+			return "", false
 		}
+
+		return attributeValue(value), true
 	}
+	remove := func(name string) { delete(message.MessageAttributes, name) }
 
-	return messages, nil
+	body, err := c.decode(ctx, *queueName, []byte(aws.StringValue(message.Body)), message.ReceiptHandle, attribute, remove)
+	if err != nil {
+		return err
+	}
+
+	message.Body = aws.String(string(body))
+	return nil
 }
 
 // ReceiveSQSEvent unpacks payloads in a Lambda SQSEvent if compressed, encrypted or uploaded to S3 by the sennder.
 func (c *Client) ReceiveSQSEvent(event *events.SQSEvent) (*events.SQSEvent, error) {
-	// Loop through messages and check if payload is located in S3 and/or if its encrypted.
-	for i := range event.Records {
-		// If S3 bucket is included the payload is located in S3 an needs to be fetched
-		if _, exists := event.Records[i].MessageAttributes[AttributeNameS3Bucket]; exists && c.awsS3Client != nil {
-			var fe fileEvent
-			if err := json.Unmarshal([]byte(event.Records[i].Body), &fe); err != nil {
-				return nil, err
-			}
+	return c.ReceiveSQSEventWithContext(aws.BackgroundContext(), event)
+}
 
-			if payload, err := c.awsS3Client.getObject(&fe); err == nil {
-				event.Records[i].Body = string(payload)
-				delete(event.Records[i].MessageAttributes, AttributeNameS3Bucket)
-			} else {
-				return nil, err
-			}
+// ReceiveSQSEventWithContext is the same as ReceiveSQSEvent with the addition of a context. Pass the context given to the Lambda
+// handler to respect the Lambda deadline when fetching from S3 and decrypting with KMS.
+func (c *Client) ReceiveSQSEventWithContext(ctx aws.Context, event *events.SQSEvent) (*events.SQSEvent, error) {
+	// Loop through messages and unpack payloads which are located in S3, encrypted or otherwise encoded.
+	for i := range event.Records {
+		if err := c.decodeRecord(ctx, &event.Records[i]); err != nil {
+			return nil, err
 		}
+	}
 
-		// If KMS key is included the payload is encrypted and needs to be decrypted
-		if _, exists := event.Records[i].MessageAttributes[AttributeNameKMSKey]; exists && c.awsKMSClient != nil {
-			var ee encryptedEvent
-			if err := json.Unmarshal([]byte(event.Records[i].Body), &ee); err != nil {
-				return nil, err
-			}
+	return event, nil
+}
 
-			if decrypted, err := c.awsKMSClient.decrypt(&ee); err == nil {
-				event.Records[i].Body = string(decrypted)
-				delete(event.Records[i].MessageAttributes, AttributeNameKMSKey)
-			} else {
-				return nil, err
-			}
+// decodeRecord unpacks the payload of a single record of a SQSEvent. The record is left as received if unpacking fails.
+func (c *Client) decodeRecord(ctx aws.Context, record *events.SQSMessage) error {
+	attribute := func(name string) (string, bool) {
+		value, exists := record.MessageAttributes[name]
+		if !exists {
+			return "", false
 		}
 
-		// If compression key is included the payload needs to be decompressed
-		if _, exists := event.Records[i].MessageAttributes[AttributeCompression]; exists {
-			buf := []byte(event.Records[i].Body)
-			if decompressed, err := decompressData(buf); err == nil {
-				event.Records[i].Body = string(decompressed)
-				delete(event.Records[i].MessageAttributes, AttributeCompression)
-			} else {
-				return nil, err
-			}
+		if value.StringValue == nil && value.BinaryValue != nil {
+			return string(value.BinaryValue), true
 		}
-	}
-
-	return event, nil
-}
 
-func decompressData(payload []byte) ([]byte, error) {
-	base64Text := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
-	l, err := base64.StdEncoding.Decode(base64Text, payload)
-	if err != nil {
-		return nil, err
+		return aws.StringValue(value.StringValue), true
 	}
 
-	buf := bytes.NewBuffer(base64Text[:l])
-	zr, err := gzip.NewReader(buf)
-	if err != nil {
-		return nil, err
-	}
+	// Attributes are removed when the whole payload is unpacked
+	var removed []string
+	remove := func(name string) { removed = append(removed, name) }
 
-	decompressedBytes, err := ioutil.ReadAll(zr)
+	body, err := c.decode(ctx, queueNameFromARN(record.EventSourceARN), []byte(record.Body), nil, attribute, remove)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := zr.Close(); err != nil {
-		return nil, err
+	record.Body = string(body)
+	for _, name := range removed {
+		delete(record.MessageAttributes, name)
 	}
 
-	return decompressedBytes, nil
+	return nil
 }
 
 // ChangeMessageVisibility changes the visibilty of a message. Essentially putting it back in the queue and unavailable for a
-// specified amount of time.
+// specified amount of time. Stops the heartbeat of the message if one is running.
 func (c *Client) ChangeMessageVisibility(queueName *string, message *sqs.Message, timeout int64) error {
-	return c.awsSQSClient.changeMessageVisibility(queueName, message, timeout)
+	return c.ChangeMessageVisibilityWithContext(aws.BackgroundContext(), queueName, message, timeout)
+}
+
+// ChangeMessageVisibilityWithContext is the same as ChangeMessageVisibility with the addition of a context.
+func (c *Client) ChangeMessageVisibilityWithContext(ctx aws.Context, queueName *string, message *sqs.Message, timeout int64) error {
+	c.heartbeats.stop(message.ReceiptHandle)
+
+	return c.awsSQSClient.changeMessageVisibility(ctx, queueName, message, timeout)
 }
 
 // Backoff is used for changing message visibility based on a calculated amount of time determined by a back off function
-// configured on the awsSQSClient.
+// configured on the awsSQSClient. Stops the heartbeat of the message if one is running.
 func (c *Client) Backoff(queueName *string, message *sqs.Message) error {
-	receivedCount, err := strconv.Atoi(*message.Attributes["ApproximateReceiveCount"])
+	return c.BackoffWithContext(aws.BackgroundContext(), queueName, message)
+}
+
+// BackoffWithContext is the same as Backoff with the addition of a context.
+func (c *Client) BackoffWithContext(ctx aws.Context, queueName *string, message *sqs.Message) error {
+	c.heartbeats.stop(message.ReceiptHandle)
+
+	if c.opts.backoffFunction == nil {
+		return ErrorBackoffFunctionNotSet
+	}
+
+	receivedCount, err := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
 	if err != nil {
 		return errors.New("error getting received count")
 	}
@@ -460,12 +735,72 @@ func (c *Client) Backoff(queueName *string, message *sqs.Message) error {
 	receivedCount64 := int64(receivedCount)
 
 	timeout := c.opts.backoffFunction(receivedCount64, c.opts.initialVisibilityTimeout, c.opts.maxVisibilityTimeout, c.opts.backoffFactor)
-	return c.awsSQSClient.changeMessageVisibility(queueName, message, timeout)
+	if err := c.awsSQSClient.changeMessageVisibility(ctx, queueName, message, timeout); err != nil {
+		return err
+	}
+
+	// The message will be received again with a new receipt handle, so there is no need to remember the payload
+	c.payloads.take(message.ReceiptHandle)
+	return nil
 }
 
-// DeleteMessage removes a message from the queue.
+// DeleteMessage removes a message from the queue. If DeleteS3Payloads is enabled the payload of the message is deleted from S3
+// after the message is deleted from the queue. Stops the heartbeat of the message if one is running.
 func (c *Client) DeleteMessage(queueName *string, receiptHandle *string) error {
-	return c.awsSQSClient.deleteMessage(queueName, receiptHandle)
+	return c.DeleteMessageWithContext(aws.BackgroundContext(), queueName, receiptHandle)
+}
+
+// DeleteMessageWithContext is the same as DeleteMessage with the addition of a context.
+func (c *Client) DeleteMessageWithContext(ctx aws.Context, queueName *string, receiptHandle *string) error {
+	c.heartbeats.stop(receiptHandle)
+
+	// The delete buffer deletes the S3 payload when the batch has been sent
+	if c.opts.deleteBufferLinger > 0 {
+		if b := c.deletes.get(c, queueName, c.opts.deleteBufferLinger); b != nil {
+			return b.delete(ctx, receiptHandle)
+		}
+	}
+
+	if err := c.awsSQSClient.deleteMessage(ctx, queueName, receiptHandle); err != nil {
+		return err
+	}
+
+	return c.deleteS3Payload(ctx, receiptHandle)
+}
+
+// deleteS3Payload deletes the payload of a deleted message from S3 if the client remembers where it is located. The location is
+// kept if the delete fails, so it can be retried with DeletePayload.
+func (c *Client) deleteS3Payload(ctx aws.Context, receiptHandle *string) error {
+	if fe, exists := c.payloads.take(receiptHandle); exists {
+		if err := c.awsS3Client.deleteObject(ctx, fe); err != nil {
+			c.payloads.put(receiptHandle, fe)
+			return fmt.Errorf("error deleting object from S3: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// DeletePayload deletes the payload of a received message from S3 without deleting the message from the queue. Only payloads of
+// messages received while DeleteS3Payloads is enabled can be deleted. Does nothing if the payload of the message is not in S3.
+func (c *Client) DeletePayload(message *sqs.Message) error {
+	return c.DeletePayloadWithContext(aws.BackgroundContext(), message)
+}
+
+// DeletePayloadWithContext is the same as DeletePayload with the addition of a context.
+func (c *Client) DeletePayloadWithContext(ctx aws.Context, message *sqs.Message) error {
+	fe, exists := c.payloads.take(message.ReceiptHandle)
+	if !exists {
+		return nil
+	}
+
+	if err := c.awsS3Client.deleteObject(ctx, fe); err != nil {
+		// Keep the entry so deletion can be retried
+		c.payloads.put(message.ReceiptHandle, fe)
+		return fmt.Errorf("error deleting object from S3: %v", err)
+	}
+
+	return nil
 }
 
 // ExponentialBackoff can be configured on a client to achieve an exponential backoff strategy based on how many times the message
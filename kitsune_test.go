@@ -2,7 +2,13 @@ package kitsune
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
@@ -12,8 +18,15 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/larwef/kitsune/test"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestClient_SendMessage(t *testing.T) {
@@ -29,10 +42,15 @@ func getClient(awsSQS sqsiface.SQSAPI, awsS3 s3iface.S3API, awsKMS kmsiface.KMSA
 		o(&opts)
 	}
 
+	provider := opts.keyProvider
+	if provider == nil {
+		provider = &KMSKeyProvider{awsKMS: awsKMS}
+	}
+
 	return &Client{
 		awsSQSClient: newSQSClient(awsSQS, &opts),
 		awsS3Client:  newS3Client(awsS3),
-		awsKMSClient: newKMSClient(awsKMS, &opts),
+		awsKMSClient: newKMSClient(provider, &opts),
 		opts:         opts,
 	}
 }
@@ -45,7 +63,7 @@ func sendNMessages(t *testing.T, n int) {
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
 	for i := 0; i < n; i++ {
-		err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"+strconv.Itoa(i)))
+		_, err := sqsClient.SendMessage(&testQueue, []byte("Testpayload"+strconv.Itoa(i)))
 		test.AssertNotError(t, err)
 	}
 
@@ -67,7 +85,7 @@ func TestClient_SendMessage_MaxSize(t *testing.T) {
 	testQueue := "test-queue"
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
-	err = sqsClient.SendMessage(&testQueue, payload)
+	_, err = sqsClient.SendMessage(&testQueue, payload)
 	test.AssertNotError(t, err)
 
 	_, err = sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
@@ -91,7 +109,7 @@ func TestClient_SendMessageWithAttributes_MaxSize(t *testing.T) {
 	attributes["a3"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaa")}
 	attributes["a4"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaa")}
 
-	err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
+	_, err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
 	test.AssertNotError(t, err)
 
 	_, err = sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
@@ -108,7 +126,7 @@ func TestClient_SendMessage_OverMaxSizeS3NotConfigured(t *testing.T) {
 	testQueue := "test-queue"
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
-	err = sqsClient.SendMessage(&testQueue, payload)
+	_, err = sqsClient.SendMessage(&testQueue, payload)
 	test.AssertIsError(t, err)
 	test.AssertEqual(t, err, ErrorMaxMessageSizeExceeded)
 }
@@ -130,7 +148,7 @@ func TestClient_SendMessageWithAttributes_OverMaxSizeS3NotConfigured(t *testing.
 	attributes["a3"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaa")}
 	attributes["a4"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaaa")}
 
-	err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
+	_, err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
 	test.AssertIsError(t, err)
 	test.AssertEqual(t, err, ErrorMaxMessageSizeExceeded)
 }
@@ -154,7 +172,7 @@ func TestClient_SendMessage_OverMaxSize(t *testing.T) {
 	testQueue := "test-queue"
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
-	err = sqsClient.SendMessage(&testQueue, payload)
+	_, err = sqsClient.SendMessage(&testQueue, payload)
 	test.AssertNotError(t, err)
 
 	test.AssertEqual(t, s3Mock.PutObjectHandlerCalledCount, 1)
@@ -198,7 +216,7 @@ func TestClient_SendMessageWithAttributes_OverMaxSize(t *testing.T) {
 	attributes["a3"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaa")}
 	attributes["a4"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("Aaaaaaaaa")}
 
-	err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
+	_, err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
 	test.AssertNotError(t, err)
 
 	test.AssertEqual(t, s3Mock.PutObjectHandlerCalledCount, 1)
@@ -238,11 +256,72 @@ func TestClient_SendMessageWithAttributes_MaxNoOfAttributesExceeded(t *testing.T
 	attributes["a10"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("TestAttribute10")}
 	attributes["a11"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("TestAttribute11")}
 
-	err := sqsClient.SendMessageWithAttributes(&testQueue, []byte(payload), attributes)
+	_, err := sqsClient.SendMessageWithAttributes(&testQueue, []byte(payload), attributes)
 	test.AssertIsError(t, err)
 	test.AssertEqual(t, err, ErrorMaxNumberOfAttributesExceeded)
 }
 
+func TestClient_SendMessageWithAttributes_BinaryAndNumberSize(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	payload, err := ioutil.ReadFile("test/testdata/size262080Bytes.txt")
+	test.AssertNotError(t, err)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	attributes := make(map[string]*sqs.MessageAttributeValue)
+	attributes["b1"] = &sqs.MessageAttributeValue{DataType: aws.String("Binary"), BinaryValue: make([]byte, 40)}
+	attributes["n1"] = &sqs.MessageAttributeValue{DataType: aws.String("Number.int"), StringValue: aws.String("123")}
+
+	// 262080 + (2 + 6 + 40) + (2 + 10 + 3) = 262143
+	test.AssertEqual(t, size(payload, attributes), 262143)
+
+	_, err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
+	test.AssertNotError(t, err)
+
+	attributes["b1"].BinaryValue = make([]byte, 42)
+	_, err = sqsClient.SendMessageWithAttributes(&testQueue, payload, attributes)
+	test.AssertEqual(t, err, ErrorMaxMessageSizeExceeded)
+}
+
+func TestValidateAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value *sqs.MessageAttributeValue
+		err   error
+	}{
+		{name: "valid-name_1.a", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}},
+		{name: "custom", value: &sqs.MessageAttributeValue{DataType: aws.String("String.json"), StringValue: aws.String("{}")}},
+		{name: "number", value: &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("-1.5e10")}},
+		{name: "binary", value: &sqs.MessageAttributeValue{DataType: aws.String("Binary"), BinaryValue: []byte{0}}},
+		{name: "AWS.reserved", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeName},
+		{name: "amazon.reserved", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeName},
+		{name: ".period", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeName},
+		{name: "double..period", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeName},
+		{name: "space in name", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeName},
+		{name: "nil", value: nil, err: ErrorInvalidAttributeDataType},
+		{name: "missingType", value: &sqs.MessageAttributeValue{StringValue: aws.String("value")}, err: ErrorInvalidAttributeDataType},
+		{name: "unknownType", value: &sqs.MessageAttributeValue{DataType: aws.String("Text"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeDataType},
+		{name: "emptyLabel", value: &sqs.MessageAttributeValue{DataType: aws.String("String."), StringValue: aws.String("value")}, err: ErrorInvalidAttributeDataType},
+		{name: "missingBinary", value: &sqs.MessageAttributeValue{DataType: aws.String("Binary"), StringValue: aws.String("value")}, err: ErrorInvalidAttributeValue},
+		{name: "missingString", value: &sqs.MessageAttributeValue{DataType: aws.String("String")}, err: ErrorInvalidAttributeValue},
+		{name: "emptyString", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("")}, err: ErrorInvalidAttributeValue},
+		{name: "invalidCharacter", value: &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("a\x00b")}, err: ErrorInvalidAttributeValue},
+		{name: "notNumber", value: &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("1,5")}, err: ErrorInvalidAttributeValue},
+		{name: "tooPrecise", value: &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("1." + strings.Repeat("1", 38))}, err: ErrorInvalidAttributeValue},
+		{name: "tooLarge", value: &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("1e127")}, err: ErrorInvalidAttributeValue},
+	}
+
+	for _, tt := range tests {
+		err := validateAttributes(map[string]*sqs.MessageAttributeValue{tt.name: tt.value})
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
 func TestClient_ReceiveMessage(t *testing.T) {
 	for i := 1; i <= 100; i++ {
 		receiveNMessages(t, i)
@@ -342,7 +421,7 @@ func TestClient_SendMessage_KMS(t *testing.T) {
 	testQueue := "test-queue"
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
-	err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
 	test.AssertNotError(t, err)
 
 	message, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
@@ -405,7 +484,7 @@ func TestClient_SendMessage_WithKMSCache(t *testing.T) {
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
 	for i := 0; i < 5; i++ {
-		err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
 		test.AssertNotError(t, err)
 	}
 
@@ -464,7 +543,7 @@ func TestClient_SendAndReceiveMessage_WithKMSCache(t *testing.T) {
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
 	for i := 0; i < 5; i++ {
-		err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"+strconv.Itoa(i)))
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"+strconv.Itoa(i)))
 		test.AssertNotError(t, err)
 	}
 
@@ -490,14 +569,14 @@ func TestClient_SendMessage_Compressed(t *testing.T) {
 	testQueue := "test-queue"
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
-	err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
 	test.AssertNotError(t, err)
 
 	message, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
 	test.AssertNotError(t, err)
 
 	buf := []byte(*message[0].Body)
-	decompressed, err := decompressData(buf)
+	decompressed, err := decompressData(buf, "gzip", DefaultMaxDecompressedSize)
 	test.AssertNotError(t, err)
 	test.AssertEqual(t, string(decompressed), "TestPayload")
 }
@@ -510,7 +589,7 @@ func TestClient_ReceiveMessage_Compressed(t *testing.T) {
 	sqsMock.CreateQueueIfNotExists(&testQueue)
 
 	buf := []byte("TestPayload")
-	compressed, err := compressData(buf)
+	compressed, err := compressData(buf, CompressionGzip, DefaultCompressionLevel)
 	test.AssertNotError(t, err)
 
 	messageAttributes := make(map[string]*sqs.MessageAttributeValue)
@@ -532,6 +611,105 @@ func TestClient_ReceiveMessage_Compressed(t *testing.T) {
 	test.AssertEqual(t, *messages[0].Body, "TestPayload")
 }
 
+func TestClient_SendMessage_CompressionAlgorithms(t *testing.T) {
+	algorithms := []CompressionAlgorithm{CompressionGzip, CompressionDeflate, CompressionZstd, CompressionSnappy, CompressionBrotli}
+
+	for _, algorithm := range algorithms {
+		sqsMock := test.NewSQSMock(5, int64(10))
+		sqsClient := getClient(sqsMock, nil, nil, Compression(algorithm), CompressionLevel(1))
+
+		testQueue := "test-queue"
+		sqsMock.CreateQueueIfNotExists(&testQueue)
+
+		payload := strings.Repeat("{\"measurement\":\"temperature\",\"value\":21.5}", 100)
+		_, err := sqsClient.SendMessage(&testQueue, []byte(payload))
+		test.AssertNotError(t, err)
+
+		messages, err := sqsClient.ReceiveMessages(&testQueue)
+		test.AssertNotError(t, err)
+		test.AssertEqual(t, len(messages), 1)
+		test.AssertEqual(t, *messages[0].Body, payload)
+		test.AssertEqual(t, len(messages[0].MessageAttributes), 0)
+	}
+}
+
+func TestClient_SendMessage_MessageCompression(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageCompression(CompressionZstd))
+	test.AssertNotError(t, err)
+
+	message, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *message[0].MessageAttributes[AttributeCompression].StringValue, "zstd")
+
+	decompressed, err := decompressData([]byte(*message[0].Body), "zstd", DefaultMaxDecompressedSize)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, string(decompressed), "TestPayload")
+}
+
+func TestClient_SendMessage_CompressionThreshold(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, CompressionThreshold(100))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	compressible := strings.Repeat("TestPayload", 20)
+	randomBytes := make([]byte, 225)
+	_, err := rand.Read(randomBytes)
+	test.AssertNotError(t, err)
+	random := base64.StdEncoding.EncodeToString(randomBytes)
+
+	payloads := []string{"TestPayload", compressible, random}
+	for _, payload := range payloads {
+		_, err := sqsClient.SendMessage(&testQueue, []byte(payload))
+		test.AssertNotError(t, err)
+	}
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 3)
+	test.AssertNotError(t, err)
+
+	// Below threshold
+	test.AssertEqual(t, *messages[0].Body, "TestPayload")
+	test.AssertEqual(t, len(messages[0].MessageAttributes), 0)
+
+	// Above threshold and compressible
+	test.AssertEqual(t, *messages[1].MessageAttributes[AttributeCompression].StringValue, "gzip")
+	test.AssertEqual(t, len(*messages[1].Body) < len(compressible), true)
+
+	// Above threshold, but not smaller when compressed
+	test.AssertEqual(t, *messages[2].Body, random)
+	test.AssertEqual(t, len(messages[2].MessageAttributes), 0)
+}
+
+func TestClient_ReceiveMessage_UnsupportedCompression(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	compressed, err := compressData([]byte("TestPayload"), CompressionGzip, DefaultCompressionLevel)
+	test.AssertNotError(t, err)
+
+	_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+		MessageBody: aws.String(string(compressed)),
+		QueueUrl:    &testQueue,
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			AttributeCompression: {DataType: aws.String("String"), StringValue: aws.String("lz4")},
+		},
+	})
+	test.AssertNotError(t, err)
+
+	_, err = sqsClient.ReceiveMessages(&testQueue)
+	test.AssertEqual(t, err, ErrorUnsupportedCompression)
+}
+
 func TestClient_ReceiveSQSEvent(t *testing.T) {
 	for i := 1; i <= 10; i++ {
 		receiveSQSEventWithNRecords(t, i)
@@ -649,3 +827,1992 @@ func TestClient_ReceiveSQSEvent_KMS(t *testing.T) {
 	test.AssertNotError(t, err)
 	test.AssertEqual(t, receivedEvent.Records[0].Body, "TestPayload")
 }
+
+func TestClient_SendMessageBatch(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(35))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	var entries []BatchEntry
+	for i := 0; i < 25; i++ {
+		entries = append(entries, BatchEntry{ID: strconv.Itoa(i), Payload: []byte("Testpayload" + strconv.Itoa(i))})
+	}
+
+	results := sqsClient.SendMessageBatch(&testQueue, entries)
+	test.AssertEqual(t, len(results), 25)
+	for i, result := range results {
+		test.AssertEqual(t, result.ID, strconv.Itoa(i))
+		test.AssertNotError(t, result.Err)
+	}
+	test.AssertEqual(t, sqsMock.SendMessageBatchCalledCount, 3)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 25)
+	test.AssertNotError(t, err)
+	for i, message := range messages {
+		test.AssertEqual(t, *message.Body, "Testpayload"+strconv.Itoa(i))
+	}
+}
+
+func TestClient_SendMessageBatch_SplitOnSize(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	payload := bytes.Repeat([]byte("a"), 100*1024)
+	entries := []BatchEntry{{Payload: payload}, {Payload: payload}, {Payload: payload}, {Payload: payload}, {Payload: payload}}
+
+	results := sqsClient.SendMessageBatch(&testQueue, entries)
+	for _, result := range results {
+		test.AssertNotError(t, result.Err)
+	}
+	test.AssertEqual(t, sqsMock.SendMessageBatchCalledCount, 3)
+
+	_, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 5)
+	test.AssertNotError(t, err)
+}
+
+func TestClient_SendMessageBatch_OverMaxSizeS3NotConfigured(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	payload, err := ioutil.ReadFile("test/testdata/size262145Bytes.txt")
+	test.AssertNotError(t, err)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	entries := []BatchEntry{{ID: "ok1", Payload: []byte("Testpayload")}, {ID: "tooLarge", Payload: payload}, {ID: "ok2", Payload: []byte("Testpayload")}}
+
+	results := sqsClient.SendMessageBatch(&testQueue, entries)
+	test.AssertNotError(t, results[0].Err)
+	test.AssertEqual(t, results[1].ID, "tooLarge")
+	test.AssertEqual(t, results[1].Err, ErrorMaxMessageSizeExceeded)
+	test.AssertNotError(t, results[2].Err)
+
+	_, err = sqsMock.WaitUntilMessagesReceived(&testQueue, 2)
+	test.AssertNotError(t, err)
+}
+
+func TestClient_SendMessageBatch_OverMaxSize(t *testing.T) {
+	payload, err := ioutil.ReadFile("test/testdata/size262145Bytes.txt")
+	test.AssertNotError(t, err)
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		test.AssertEqual(t, *input.Bucket, "test-bucket")
+		return &s3.PutObjectOutput{}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, nil, S3Bucket("test-bucket"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	entries := []BatchEntry{{Payload: []byte("Testpayload")}, {Payload: payload}}
+
+	results := sqsClient.SendMessageBatch(&testQueue, entries)
+	for _, result := range results {
+		test.AssertNotError(t, result.Err)
+	}
+	test.AssertEqual(t, s3Mock.PutObjectHandlerCalledCount, 1)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 2)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *messages[0].Body, "Testpayload")
+	test.AssertEqual(t, *messages[1].MessageAttributes[AttributeNameS3Bucket].StringValue, "test-bucket")
+}
+
+func TestClient_SendMessageWithContext_Cancelled(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := sqsClient.SendMessageWithContext(ctx, &testQueue, []byte("TestPayload"))
+	test.AssertIsError(t, err)
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 0)
+
+	_, err = sqsMock.WaitUntilMessagesReceived(&testQueue, 0)
+	test.AssertNotError(t, err)
+}
+
+func TestClient_ReceiveMessagesWithContext_Cancelled(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = sqsClient.ReceiveMessagesWithContext(ctx, &testQueue)
+	test.AssertEqual(t, err, context.Canceled)
+}
+
+func TestClient_SendMessage_FIFO(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"))
+
+	testQueue := "test-queue.fifo"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageGroupID("group1"), ContentDeduplication(true))
+	test.AssertNotError(t, err)
+
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageGroupID("group1"), MessageDeduplicationID("dedup"))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+
+	// The deduplication id is derived from the payload before encryption.
+	test.AssertEqual(t, *messages[0].Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId], contentDeduplicationID([]byte("TestPayload")))
+	test.AssertEqual(t, *messages[1].Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId], "dedup")
+
+	for i, message := range messages {
+		test.AssertEqual(t, *message.Body, "TestPayload")
+		test.AssertEqual(t, MessageGroupIDOf(message), "group1")
+		test.AssertEqual(t, SequenceNumberOf(message), strconv.Itoa(i+1))
+	}
+}
+
+func TestClient_SendMessage_FIFOWithoutMessageGroupID(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue.fifo"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertEqual(t, err, ErrorMessageGroupIDRequired)
+}
+
+func TestClient_SendMessageBatch_FIFO(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue.fifo"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	entries := []BatchEntry{
+		{Payload: []byte("Testpayload0"), Options: []SendOption{MessageGroupID("group1"), ContentDeduplication(true)}},
+		{Payload: []byte("Testpayload1")},
+	}
+
+	results := sqsClient.SendMessageBatch(&testQueue, entries)
+	test.AssertNotError(t, results[0].Err)
+	test.AssertEqual(t, results[1].Err, ErrorMessageGroupIDRequired)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, MessageGroupIDOf(messages[0]), "group1")
+}
+
+func TestClient_SendMessage_Result(t *testing.T) {
+	payload, err := ioutil.ReadFile("test/testdata/size262145Bytes.txt")
+	test.AssertNotError(t, err)
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return &s3.PutObjectOutput{}, nil
+	}
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, s3Mock, kmsMock, S3Bucket("test-bucket"), KMSKeyID("keyID"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result, err := sqsClient.SendMessage(&testQueue, payload)
+	test.AssertNotError(t, err)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	var fe fileEvent
+	err = json.Unmarshal([]byte(*messages[0].Body), &fe)
+	test.AssertNotError(t, err)
+
+	test.AssertEqual(t, len(result.MessageID), 36)
+	test.AssertEqual(t, result.MD5OfMessageBody, fmt.Sprintf("%x", md5.Sum([]byte(*messages[0].Body))))
+	test.AssertEqual(t, result.S3Bucket, "test-bucket")
+	test.AssertEqual(t, result.S3Key, *fe.Filename)
+	test.AssertEqual(t, result.KMSKeyID, "keyID")
+}
+
+func TestClient_SendMessageBatch_Result(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	results := sqsClient.SendMessageBatch(&testQueue, []BatchEntry{{Payload: []byte("Testpayload0")}, {Payload: []byte("Testpayload1")}})
+	for _, result := range results {
+		test.AssertNotError(t, result.Err)
+		test.AssertEqual(t, len(result.MessageID), 36)
+		test.AssertEqual(t, result.S3Key, "")
+	}
+}
+
+func TestClient_SendMessage_SendOptions(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageKMSKeyID("keyID"), MessageCompressionEnabled(true))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, result.KMSKeyID, "keyID")
+
+	result, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, result.KMSKeyID, "")
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 2)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 1)
+
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeNameKMSKey].StringValue, "keyID")
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeCompression].StringValue, "gzip")
+	test.AssertEqual(t, len(messages[1].MessageAttributes), 0)
+	test.AssertEqual(t, *messages[1].Body, "TestPayload")
+}
+
+func TestClient_SendMessage_SendOptionsOverrideClient(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return &s3.PutObjectOutput{}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, kmsMock, KMSKeyID("keyID"), S3Bucket("test-bucket"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageKMSKeyID(""), MessageForceS3(true))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, result.KMSKeyID, "")
+	test.AssertEqual(t, result.S3Bucket, "test-bucket")
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 0)
+	test.AssertEqual(t, s3Mock.PutObjectHandlerCalledCount, 1)
+}
+
+func TestClient_SendMessage_JavaPointerFormat(t *testing.T) {
+	payload, err := ioutil.ReadFile("test/testdata/size262145Bytes.txt")
+	test.AssertNotError(t, err)
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return &s3.PutObjectOutput{}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, nil, S3Bucket("test-bucket"), S3PointerFormat(PointerFormatJava))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result, err := sqsClient.SendMessage(&testQueue, payload)
+	test.AssertNotError(t, err)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	expectedBody := `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"test-bucket","s3Key":"` + result.S3Key + `"}]`
+	test.AssertEqual(t, *messages[0].Body, expectedBody)
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeNameExtendedPayloadSize].DataType, "Number")
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeNameExtendedPayloadSize].StringValue, "262145")
+
+	_, exists := messages[0].MessageAttributes[AttributeNameS3Bucket]
+	test.AssertEqual(t, exists, false)
+}
+
+func TestClient_ReceiveMessage_JavaPointerFormat(t *testing.T) {
+	payload, err := ioutil.ReadFile("test/testdata/size262145Bytes.txt")
+	test.AssertNotError(t, err)
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		test.AssertEqual(t, *input.Bucket, "java-bucket")
+		test.AssertEqual(t, *input.Key, "testFile")
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewReader(payload)),
+		}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, nil, S3Bucket("test-bucket"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	messageAttributes := make(map[string]*sqs.MessageAttributeValue)
+	messageAttributes[AttributeNameExtendedPayloadSize] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String("262145"),
+	}
+
+	sendMessageInput := &sqs.SendMessageInput{
+		MessageBody:       aws.String(`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"java-bucket","s3Key":"testFile"}]`),
+		QueueUrl:          &testQueue,
+		MessageAttributes: messageAttributes,
+	}
+	_, err = sqsMock.SendMessage(sendMessageInput)
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *messages[0].Body, string(payload))
+	test.AssertEqual(t, len(messages[0].MessageAttributes), 0)
+}
+
+func TestClient_ReceiveSQSEvent_JavaPointerFormat(t *testing.T) {
+	s3Mock := &test.S3Mock{}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		test.AssertEqual(t, *input.Bucket, "java-bucket")
+		test.AssertEqual(t, *input.Key, "testFile")
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewBufferString("TestPayload")),
+		}, nil
+	}
+	sqsClient := getClient(nil, s3Mock, nil, S3Bucket("test-bucket"))
+
+	messageAttributes := make(map[string]events.SQSMessageAttribute)
+	messageAttributes[AttributeNameLegacyPayloadSize] = events.SQSMessageAttribute{
+		DataType:    "Number",
+		StringValue: aws.String("11"),
+	}
+
+	sqsEvent := events.SQSEvent{
+		Records: []events.SQSMessage{{
+			Body:              `["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"java-bucket","s3Key":"testFile"}]`,
+			MessageAttributes: messageAttributes,
+		}},
+	}
+
+	receivedEvent, err := sqsClient.ReceiveSQSEvent(&sqsEvent)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, receivedEvent.Records[0].Body, "TestPayload")
+}
+
+func TestClient_DeleteMessage_DeleteS3Payloads(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewBufferString("TestPayload")),
+		}, nil
+	}
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		test.AssertEqual(t, *input.Bucket, "test-bucket")
+		test.AssertEqual(t, *input.Key, "testFile")
+		return &s3.DeleteObjectOutput{}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, nil, S3Bucket("test-bucket"), DeleteS3Payloads(true))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	fe := &fileEvent{
+		Size:     aws.Int64(int64(11)),
+		Bucket:   aws.String("test-bucket"),
+		Filename: aws.String("testFile"),
+	}
+
+	febytes, err := json.Marshal(fe)
+	test.AssertNotError(t, err)
+
+	for i := 0; i < 2; i++ {
+		messageAttributes := make(map[string]*sqs.MessageAttributeValue)
+		messageAttributes[AttributeNameS3Bucket] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String("test-bucket"),
+		}
+
+		_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+			MessageBody:       aws.String(string(febytes)),
+			QueueUrl:          &testQueue,
+			MessageAttributes: messageAttributes,
+		})
+		test.AssertNotError(t, err)
+	}
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+
+	err = sqsClient.DeleteMessage(&testQueue, messages[0].ReceiptHandle)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+
+	err = sqsClient.DeletePayload(messages[1])
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 2)
+
+	// Payload is already deleted, so nothing should happen.
+	err = sqsClient.DeleteMessage(&testQueue, messages[1].ReceiptHandle)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 2)
+}
+
+// prefixCodec is a test codec which prefixes the payload with a fixed value.
+type prefixCodec struct {
+	prefix string
+}
+
+func (p *prefixCodec) Attribute() string {
+	return "prefix"
+}
+
+func (p *prefixCodec) Encode(ctx aws.Context, payload []byte) ([]byte, string, error) {
+	return append([]byte(p.prefix), payload...), p.prefix, nil
+}
+
+func (p *prefixCodec) Decode(ctx aws.Context, payload []byte, value string) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte(value)) {
+		return nil, errors.New("missing prefix")
+	}
+
+	return payload[len(value):], nil
+}
+
+func TestClient_SendAndReceiveMessage_CustomCodec(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	pipeline := NewPipeline().Compression().Codec(&prefixCodec{prefix: "signed:"}).Encryption()
+	sqsClient := getClient(sqsMock, nil, kmsMock, Pipeline(pipeline), CompressionEnabled(true), KMSKeyID("keyID"))
+	test.AssertEqual(t, containsString(sqsClient.opts.messageAttributeNames, "prefix"), true)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	// Check the order of the stages by decrypting the message on the queue.
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *messages[0].MessageAttributes["prefix"].StringValue, "signed:")
+
+	var ee encryptedEvent
+	err = json.Unmarshal([]byte(*messages[0].Body), &ee)
+	test.AssertNotError(t, err)
+	decrypted, err := test.DecryptData(ee.Payload)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, strings.HasPrefix(string(decrypted), "signed:"), true)
+
+	_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+		MessageAttributes: messages[0].MessageAttributes,
+		MessageBody:       messages[0].Body,
+		QueueUrl:          &testQueue,
+	})
+	test.AssertNotError(t, err)
+
+	received, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *received[0].Body, "TestPayload")
+	test.AssertEqual(t, len(received[0].MessageAttributes), 0)
+}
+
+func TestClient_SendAndReceiveMessage_PipelineOrder(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sender := getClient(sqsMock, nil, kmsMock, Pipeline(NewPipeline().Encryption().Compression()), CompressionEnabled(true), KMSKeyID("keyID"))
+	receiver := getClient(sqsMock, nil, kmsMock)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sender.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	// The receiver decodes in the reverse of the order the sender applied the stages, not the reverse of its own pipeline
+	received, err := receiver.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *received[0].Body, "TestPayload")
+	test.AssertEqual(t, len(received[0].MessageAttributes), 0)
+
+	_, err = sender.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeNamePipeline].StringValue, AttributeNameKMSKey+","+AttributeCompression)
+}
+
+func TestClient_SendMessage_DefaultPipelineAttributes(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, CompressionEnabled(true), KMSKeyID("keyID"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	attributes := make(map[string]*sqs.MessageAttributeValue)
+	for i := 0; i < 8; i++ {
+		attributes["a"+strconv.Itoa(i)] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("TestAttribute")}
+	}
+
+	// The default order is not recorded, which leaves room for 8 custom attributes
+	_, err := sqsClient.SendMessageWithAttributes(&testQueue, []byte("TestPayload"), attributes)
+	test.AssertNotError(t, err)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages[0].MessageAttributes), 10)
+	_, exists := messages[0].MessageAttributes[AttributeNamePipeline]
+	test.AssertEqual(t, exists, false)
+}
+
+func TestClient_ReceiveMessage_UnsupportedStage(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sender := getClient(sqsMock, nil, nil, Pipeline(NewPipeline().Compression().Codec(&prefixCodec{prefix: "signed:"})), CompressionEnabled(true))
+	receiver := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sender.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	// The payload is not returned still encoded when the receiver does not know a stage
+	_, err = receiver.ReceiveMessages(&testQueue)
+	test.AssertEqual(t, err, ErrorUnsupportedStage)
+}
+
+// valueCodec is a test codec which leaves the payload as is and marks it with a fixed attribute.
+type valueCodec struct {
+	attribute string
+	value     string
+}
+
+func (v *valueCodec) Attribute() string {
+	return v.attribute
+}
+
+func (v *valueCodec) Encode(ctx aws.Context, payload []byte) ([]byte, string, error) {
+	return payload, v.value, nil
+}
+
+func (v *valueCodec) Decode(ctx aws.Context, payload []byte, value string) ([]byte, error) {
+	return payload, nil
+}
+
+func TestPipeline_InvalidCodec(t *testing.T) {
+	test.AssertNotError(t, NewPipeline().Codec(&valueCodec{attribute: "signature"}).err)
+	test.AssertEqual(t, NewPipeline().Codec(&valueCodec{attribute: ""}).err, ErrorInvalidCodec)
+	test.AssertEqual(t, NewPipeline().Codec(&valueCodec{attribute: "AWS.signature"}).err, ErrorInvalidCodec)
+	test.AssertEqual(t, NewPipeline().Codec(&valueCodec{attribute: AttributeCompression}).err, ErrorInvalidCodec)
+	test.AssertEqual(t, NewPipeline().Codec(&valueCodec{attribute: "signature"}).Codec(&valueCodec{attribute: "signature"}).err, ErrorInvalidCodec)
+
+	_, err := New(nil, Pipeline(NewPipeline().Codec(&valueCodec{attribute: AttributeNamePipeline})))
+	test.AssertEqual(t, err, ErrorInvalidCodec)
+}
+
+func TestClient_SendMessage_EmptyCodecValue(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, Pipeline(NewPipeline().Codec(&valueCodec{attribute: "signature"})))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertEqual(t, err, ErrorEmptyCodecValue)
+}
+
+func TestClient_SendAndReceiveMessage_ASCII85Encoding(t *testing.T) {
+	randomBytes := make([]byte, 3000)
+	_, err := rand.Read(randomBytes)
+	test.AssertNotError(t, err)
+	payload := []byte(base64.StdEncoding.EncodeToString(randomBytes))
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, CompressionEnabled(true), KMSKeyID("keyID"), PayloadEncoding(EncodingASCII85))
+	legacyClient := getClient(sqsMock, nil, kmsMock, CompressionEnabled(true), KMSKeyID("keyID"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err = sqsClient.SendMessage(&testQueue, payload)
+	test.AssertNotError(t, err)
+	_, err = legacyClient.SendMessage(&testQueue, payload)
+	test.AssertNotError(t, err)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 2)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *messages[0].MessageAttributes[AttributeNameEncoding].StringValue, "ascii85")
+	test.AssertEqual(t, len(*messages[0].Body) < len(*messages[1].Body)*3/4, true)
+
+	_, err = sqsClient.SendMessage(&testQueue, payload)
+	test.AssertNotError(t, err)
+
+	received, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(received), 1)
+	test.AssertEqual(t, *received[0].Body, string(payload))
+	test.AssertEqual(t, len(received[0].MessageAttributes), 0)
+}
+
+func TestClient_SendAndReceiveMessage_BinaryS3Payload(t *testing.T) {
+	var object []byte
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		var err error
+		object, err = ioutil.ReadAll(input.Body)
+		return &s3.PutObjectOutput{}, err
+	}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(object))}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, kmsMock, S3Bucket("test-bucket"), ForceS3(true), KMSKeyID("keyID"), PayloadEncoding(EncodingBase64))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	// The envelope is stored raw, not base64 encoded
+	test.AssertEqual(t, object[0], byte(binaryEnvelopeVersion))
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+	test.AssertEqual(t, *messages[0].Body, "TestPayload")
+	test.AssertEqual(t, len(messages[0].MessageAttributes), 0)
+}
+
+func TestBinaryEnvelope(t *testing.T) {
+	ee := &encryptedEvent{
+		EncryptedEncryptionKey:  []byte{1, 2, 3},
+		KeyID:                   "keyID",
+		EncryptionContext:       map[string]string{"queue": "test-queue", "tenant": "tenant1"},
+		Authenticated:           true,
+		AuthenticatedAttributes: []string{AttributeCompression, "tenant"},
+		Version:                 EnvelopeVersion1,
+		Algorithm:               AlgorithmAES128GCM,
+		KeySpec:                 "AES_128",
+		Nonce:                   []byte{4, 5, 6},
+		Payload:                 []byte("TestPayload"),
+	}
+
+	decoded, err := unmarshalBinaryEnvelope(marshalBinaryEnvelope(ee))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, decoded.KeyID, ee.KeyID)
+	test.AssertEqual(t, string(decoded.EncryptedEncryptionKey), string(ee.EncryptedEncryptionKey))
+	test.AssertEqual(t, len(decoded.EncryptionContext), 2)
+	test.AssertEqual(t, decoded.EncryptionContext["queue"], "test-queue")
+	test.AssertEqual(t, decoded.EncryptionContext["tenant"], "tenant1")
+	test.AssertEqual(t, decoded.Authenticated, true)
+	test.AssertEqual(t, strings.Join(decoded.AuthenticatedAttributes, ","), AttributeCompression+",tenant")
+	test.AssertEqual(t, decoded.Version, EnvelopeVersion1)
+	test.AssertEqual(t, decoded.Algorithm, AlgorithmAES128GCM)
+	test.AssertEqual(t, decoded.KeySpec, "AES_128")
+	test.AssertEqual(t, string(decoded.Nonce), string(ee.Nonce))
+	test.AssertEqual(t, string(decoded.Payload), string(ee.Payload))
+
+	_, err = unmarshalBinaryEnvelope([]byte{binaryEnvelopeVersion, 10, 1})
+	test.AssertEqual(t, err, ErrorInvalidEnvelope)
+
+	_, err = unmarshalBinaryEnvelope([]byte{binaryEnvelopeVersion + 1, 1, 'k', 1, 1, 'p'})
+	test.AssertEqual(t, err, ErrorInvalidEnvelope)
+}
+
+func queueEncryptionContext(queueName string) map[string]string {
+	return map[string]string{"queue": queueName}
+}
+
+func TestClient_SendAndReceiveMessage_EncryptionContext(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"),
+		EncryptionContext(map[string]string{"application": "test"}), EncryptionContextFunc(queueEncryptionContext))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageEncryptionContext(map[string]string{"tenant": "tenant1", "queue": "other-queue"}))
+	test.AssertNotError(t, err)
+
+	test.AssertEqual(t, len(kmsMock.EncryptionContext), 3)
+	test.AssertEqual(t, *kmsMock.EncryptionContext["application"], "test")
+	test.AssertEqual(t, *kmsMock.EncryptionContext["queue"], "test-queue")
+	test.AssertEqual(t, *kmsMock.EncryptionContext["tenant"], "tenant1")
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+	test.AssertEqual(t, *messages[0].Body, "TestPayload")
+}
+
+func TestClient_ReceiveMessage_EncryptionContextReplayed(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), EncryptionContextFunc(queueEncryptionContext))
+
+	testQueue := "test-queue"
+	otherQueue := "other-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+	sqsMock.CreateQueueIfNotExists(&otherQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	sent, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+		MessageBody:       sent[0].Body,
+		QueueUrl:          &otherQueue,
+		MessageAttributes: sent[0].MessageAttributes,
+	})
+	test.AssertNotError(t, err)
+
+	_, err = sqsClient.ReceiveMessages(&otherQueue)
+	test.AssertEqual(t, err, ErrorEncryptionContextMismatch)
+	test.AssertEqual(t, kmsMock.DecryptCalledCount, 0)
+}
+
+func TestClient_ReceiveMessage_EncryptionContextTampered(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageEncryptionContext(map[string]string{"tenant": "tenant1"}))
+	test.AssertNotError(t, err)
+
+	sent, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+
+	var ee encryptedEvent
+	test.AssertNotError(t, json.Unmarshal([]byte(*sent[0].Body), &ee))
+	ee.EncryptionContext["tenant"] = "tenant2"
+	tampered, err := json.Marshal(ee)
+	test.AssertNotError(t, err)
+
+	// Let KMS accept the tampered encryption context to verify that the payload is bound to it
+	kmsMock.EncryptionContext = aws.StringMap(ee.EncryptionContext)
+
+	_, err = sqsMock.SendMessage(&sqs.SendMessageInput{
+		MessageBody:       aws.String(string(tampered)),
+		QueueUrl:          &testQueue,
+		MessageAttributes: sent[0].MessageAttributes,
+	})
+	test.AssertNotError(t, err)
+
+	_, err = sqsClient.ReceiveMessages(&testQueue)
+	test.AssertIsError(t, err)
+	test.AssertEqual(t, kmsMock.DecryptCalledCount, 1)
+}
+
+func sendAuthenticated(t *testing.T, sqsMock *test.SQSMock, sqsClient *Client, queueName *string) []*sqs.Message {
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"tenant": {DataType: aws.String("String"), StringValue: aws.String("tenant1")},
+	}
+
+	_, err := sqsClient.SendMessageWithAttributes(queueName, []byte("TestPayload"), attributes)
+	test.AssertNotError(t, err)
+
+	sent, err := sqsMock.WaitUntilMessagesReceived(queueName, 1)
+	test.AssertNotError(t, err)
+	return sent
+}
+
+func resend(t *testing.T, sqsMock *test.SQSMock, queueName *string, message *sqs.Message) {
+	_, err := sqsMock.SendMessage(&sqs.SendMessageInput{
+		MessageBody:       message.Body,
+		QueueUrl:          queueName,
+		MessageAttributes: message.MessageAttributes,
+	})
+	test.AssertNotError(t, err)
+}
+
+func assertTamperError(t *testing.T, err error) {
+	if _, ok := err.(*TamperError); !ok {
+		t.Errorf("Expected TamperError, got %v", err)
+	}
+}
+
+func TestClient_SendAndReceiveMessage_AuthenticatedEnvelope(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), CompressionEnabled(true), AuthenticatedAttributes("tenant"))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	sent := sendAuthenticated(t, sqsMock, sqsClient, &testQueue)
+	resend(t, sqsMock, &testQueue, sent[0])
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+	test.AssertEqual(t, *messages[0].Body, "TestPayload")
+	test.AssertEqual(t, *messages[0].MessageAttributes["tenant"].StringValue, "tenant1")
+}
+
+func TestClient_ReceiveMessage_AuthenticatedEnvelopeTampered(t *testing.T) {
+	tamper := []func(message *sqs.Message){
+		// Strip the compression attribute
+		func(message *sqs.Message) { delete(message.MessageAttributes, AttributeCompression) },
+		// Change an authenticated user attribute
+		func(message *sqs.Message) { message.MessageAttributes["tenant"].StringValue = aws.String("tenant2") },
+		// Strip an authenticated user attribute
+		func(message *sqs.Message) { delete(message.MessageAttributes, "tenant") },
+	}
+
+	for _, f := range tamper {
+		sqsMock := test.NewSQSMock(5, int64(10))
+		kmsMock := &test.KmsMock{}
+		sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), CompressionEnabled(true), AuthenticatedAttributes("tenant"))
+
+		testQueue := "test-queue"
+		sqsMock.CreateQueueIfNotExists(&testQueue)
+
+		sent := sendAuthenticated(t, sqsMock, sqsClient, &testQueue)
+		f(sent[0])
+		resend(t, sqsMock, &testQueue, sent[0])
+
+		_, err := sqsClient.ReceiveMessages(&testQueue)
+		assertTamperError(t, err)
+	}
+}
+
+func TestClient_ReceiveMessage_AuthenticatedEnvelopeRequired(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sender := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"))
+	receiver := getClient(sqsMock, nil, kmsMock, AuthenticatedEnvelope(true))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sender.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	_, err = receiver.ReceiveMessages(&testQueue)
+	assertTamperError(t, err)
+	test.AssertEqual(t, kmsMock.DecryptCalledCount, 0)
+}
+
+func TestClient_SendAndReceiveMessage_EnvelopeVersion(t *testing.T) {
+	tests := []struct {
+		options   []ClientOption
+		version   int
+		algorithm Algorithm
+		keySpec   string
+	}{
+		{options: nil, version: EnvelopeVersionLegacy, keySpec: "AES_256"},
+		{options: []ClientOption{EnvelopeVersion(EnvelopeVersion1)}, version: EnvelopeVersion1, algorithm: AlgorithmAES256GCM, keySpec: "AES_256"},
+		{options: []ClientOption{EncryptionAlgorithm(AlgorithmAES128GCM)}, version: EnvelopeVersion1, algorithm: AlgorithmAES128GCM, keySpec: "AES_128"},
+	}
+
+	for _, tc := range tests {
+		sqsMock := test.NewSQSMock(5, int64(10))
+		kmsMock := &test.KmsMock{}
+		sender := getClient(sqsMock, nil, kmsMock, append(tc.options, KMSKeyID("keyID"))...)
+		// The receiver supports every version regardless of its own options
+		receiver := getClient(sqsMock, nil, kmsMock)
+
+		testQueue := "test-queue"
+		sqsMock.CreateQueueIfNotExists(&testQueue)
+
+		_, err := sender.SendMessage(&testQueue, []byte("TestPayload"))
+		test.AssertNotError(t, err)
+		test.AssertEqual(t, kmsMock.KeySpec, tc.keySpec)
+
+		sent, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+		test.AssertNotError(t, err)
+
+		ee := &encryptedEvent{}
+		test.AssertNotError(t, json.Unmarshal([]byte(*sent[0].Body), ee))
+		test.AssertEqual(t, ee.Version, tc.version)
+		test.AssertEqual(t, ee.Algorithm, tc.algorithm)
+		if tc.version == EnvelopeVersionLegacy {
+			test.AssertEqual(t, len(ee.Nonce), 0)
+		} else {
+			test.AssertEqual(t, ee.KeySpec, tc.keySpec)
+			test.AssertEqual(t, len(ee.Nonce), 12)
+		}
+
+		resend(t, sqsMock, &testQueue, sent[0])
+
+		messages, err := receiver.ReceiveMessages(&testQueue)
+		test.AssertNotError(t, err)
+		test.AssertEqual(t, len(messages), 1)
+		test.AssertEqual(t, *messages[0].Body, "TestPayload")
+	}
+}
+
+func TestClient_ReceiveMessage_UnsupportedEnvelope(t *testing.T) {
+	envelopes := map[string]error{
+		`{"version":2,"keyId":"keyID"}`: ErrorUnsupportedEnvelopeVersion,
+		`{"version":1,"keyId":"keyID","encryptedEncryptionKey":"AQID","algorithm":"AES_512_GCM","payload":"AQID"}`: ErrorUnsupportedAlgorithm,
+	}
+
+	for envelope, expected := range envelopes {
+		sqsMock := test.NewSQSMock(5, int64(10))
+		kmsMock := &test.KmsMock{}
+		sqsClient := getClient(sqsMock, nil, kmsMock)
+
+		testQueue := "test-queue"
+		sqsMock.CreateQueueIfNotExists(&testQueue)
+
+		_, err := sqsMock.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String(envelope),
+			QueueUrl:    &testQueue,
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				AttributeNameKMSKey: {DataType: aws.String("String"), StringValue: aws.String("keyID")},
+			},
+		})
+		test.AssertNotError(t, err)
+
+		_, err = sqsClient.ReceiveMessages(&testQueue)
+		test.AssertEqual(t, err, expected)
+	}
+}
+
+func TestClient_SendMessage_KMSCacheMaxMessages(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), KMSKeyCacheEnabled(true), KMSKeyCacheMaxMessages(2))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 5; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+		test.AssertNotError(t, err)
+	}
+
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 3)
+}
+
+func TestClient_SendMessage_KMSCacheMaxBytes(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), KMSKeyCacheEnabled(true), KMSKeyCacheMaxBytes(25))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	// Two payloads of 11 bytes fit within the limit
+	for i := 0; i < 5; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+		test.AssertNotError(t, err)
+	}
+
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 3)
+}
+
+func newTestKeyCache(maxEntries int, now *time.Time) *keyCache {
+	kc := newKeyCache(&options{
+		kmsKeyCacheExpirationPeriod: time.Minute,
+		kmsKeyCacheMaxEntries:       maxEntries,
+	})
+	kc.now = func() time.Time { return *now }
+
+	return kc
+}
+
+func TestKeyCache_LRU(t *testing.T) {
+	now := time.Now()
+	kc := newTestKeyCache(2, &now)
+
+	kc.put([16]byte{1}, "", []byte{1}, nil)
+	kc.put([16]byte{2}, "", []byte{2}, nil)
+
+	// Makes 2 the least recently used
+	_, exists := kc.get([16]byte{1})
+	test.AssertEqual(t, exists, true)
+
+	kc.put([16]byte{3}, "", []byte{3}, nil)
+	test.AssertEqual(t, len(kc.entries), 2)
+
+	_, exists = kc.get([16]byte{2})
+	test.AssertEqual(t, exists, false)
+	_, exists = kc.get([16]byte{1})
+	test.AssertEqual(t, exists, true)
+	_, exists = kc.get([16]byte{3})
+	test.AssertEqual(t, exists, true)
+}
+
+func TestKeyCache_NegativeMaxEntries(t *testing.T) {
+	opts := &options{kmsKeyCacheExpirationPeriod: time.Minute}
+	KMSKeyCacheMaxEntries(-1)(opts)
+	test.AssertEqual(t, opts.kmsKeyCacheMaxEntries, NoKMSKeyCacheLimit)
+
+	kc := newKeyCache(opts)
+	defer kc.close()
+
+	for i := byte(0); i < 3; i++ {
+		kc.put([16]byte{i}, "", []byte{i}, nil)
+	}
+	test.AssertEqual(t, len(kc.entries), 3)
+}
+
+func TestKeyCache_Expiry(t *testing.T) {
+	now := time.Now()
+	kc := newTestKeyCache(NoKMSKeyCacheLimit, &now)
+
+	kc.put([16]byte{1}, "", []byte{1}, nil)
+	now = now.Add(30 * time.Second)
+	kc.put([16]byte{2}, "", []byte{2}, nil)
+
+	now = now.Add(31 * time.Second)
+	_, exists := kc.get([16]byte{1})
+	test.AssertEqual(t, exists, false)
+
+	entry, exists := kc.get([16]byte{2})
+	test.AssertEqual(t, exists, true)
+	test.AssertEqual(t, entry.plainText[0], byte(2))
+	test.AssertEqual(t, kc.expiry.Len(), 1)
+	test.AssertEqual(t, kc.lru.Len(), 1)
+}
+
+func TestKeyCache_ZeroOnEviction(t *testing.T) {
+	now := time.Now()
+	kc := newTestKeyCache(1, &now)
+
+	kc.put([16]byte{1}, "", []byte{1, 2, 3}, nil)
+	evicted := kc.entries[[16]byte{1}].plainText
+
+	// The returned key is a copy and is not affected by eviction
+	entry, exists := kc.get([16]byte{1})
+	test.AssertEqual(t, exists, true)
+
+	kc.put([16]byte{2}, "", []byte{4, 5, 6}, nil)
+	test.AssertEqual(t, string(evicted), string([]byte{0, 0, 0}))
+	test.AssertEqual(t, string(entry.plainText), string([]byte{1, 2, 3}))
+
+	expired := kc.entries[[16]byte{2}].plainText
+	now = now.Add(2 * time.Minute)
+	_, exists = kc.get([16]byte{2})
+	test.AssertEqual(t, exists, false)
+	test.AssertEqual(t, string(expired), string([]byte{0, 0, 0}))
+}
+
+func TestKeyCache_Janitor(t *testing.T) {
+	kc := newKeyCache(&options{
+		kmsKeyCacheExpirationPeriod: time.Nanosecond,
+		kmsKeyCacheMaxEntries:       NoKMSKeyCacheLimit,
+	})
+	defer kc.close()
+
+	kc.lock.Lock()
+	test.AssertEqual(t, kc.running, false)
+	kc.lock.Unlock()
+
+	// The janitor starts with the first entry and stops once the cache is empty
+	kc.put([16]byte{1}, "", []byte{1}, nil)
+	kc.lock.Lock()
+	test.AssertEqual(t, kc.running, true)
+	kc.lock.Unlock()
+
+	deadline := time.Now().Add(5 * minJanitorInterval)
+	for {
+		kc.lock.Lock()
+		running, entries := kc.running, len(kc.entries)
+		kc.lock.Unlock()
+
+		if !running {
+			test.AssertEqual(t, entries, 0)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not stop when the cache was empty")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	kmsMock := &test.KmsMock{}
+	sqsClient := getClient(sqsMock, nil, kmsMock, KMSKeyID("keyID"), KMSKeyCacheEnabled(true))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	cache := sqsClient.awsKMSClient.cache
+	var cached [][]byte
+	for _, entry := range cache.entries {
+		cached = append(cached, entry.plainText)
+	}
+	test.AssertEqual(t, len(cached), 2)
+
+	test.AssertNotError(t, sqsClient.Close())
+	test.AssertNotError(t, sqsClient.Close())
+	test.AssertEqual(t, len(cache.entries), 0)
+	for _, key := range cached {
+		test.AssertEqual(t, string(key), string(make([]byte, len(key))))
+	}
+
+	// The client still works, but keys are no longer cached
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(cache.entries), 0)
+	test.AssertEqual(t, kmsMock.GenerateDataKeyCalledCount, 2)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+}
+
+func TestParseKeyARN(t *testing.T) {
+	region, multiRegion := parseKeyARN("arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd")
+	test.AssertEqual(t, region, "us-east-1")
+	test.AssertEqual(t, multiRegion, true)
+
+	region, multiRegion = parseKeyARN("arn:aws:kms:eu-west-1:123456789012:key/1234abcd")
+	test.AssertEqual(t, region, "eu-west-1")
+	test.AssertEqual(t, multiRegion, false)
+
+	region, multiRegion = parseKeyARN("alias/myKey")
+	test.AssertEqual(t, region, "")
+	test.AssertEqual(t, multiRegion, false)
+}
+
+func getRegionClient(sqsMock *test.SQSMock, region string, kmsMocks map[string]*test.KmsMock, opt ...ClientOption) *Client {
+	client := getClient(sqsMock, nil, kmsMocks[region], opt...)
+	provider := client.awsKMSClient.provider.(*KMSKeyProvider)
+	provider.region = region
+	provider.newRegionClient = func(region string) kmsiface.KMSAPI { return kmsMocks[region] }
+
+	return client
+}
+
+func TestClient_SendMessage_KMSFailover(t *testing.T) {
+	primary := "arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd"
+	replica := "arn:aws:kms:eu-west-1:123456789012:key/mrk-1234abcd"
+	kmsMocks := map[string]*test.KmsMock{
+		"us-east-1": {Err: errors.New("service unavailable")},
+		"eu-west-1": {},
+	}
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getRegionClient(sqsMock, "us-east-1", kmsMocks, KMSKeyID(primary), KMSFailoverKeyIDs(replica))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, result.KMSKeyID, replica)
+	test.AssertEqual(t, kmsMocks["us-east-1"].GenerateDataKeyCalledCount, 1)
+	test.AssertEqual(t, kmsMocks["eu-west-1"].GenerateDataKeyCalledCount, 1)
+
+	sent, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 1)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, *sent[0].MessageAttributes[AttributeNameKMSKey].StringValue, replica)
+
+	// Failover keys are not used for a key set on the message
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageKMSKeyID(primary))
+	test.AssertIsError(t, err)
+}
+
+func TestClient_ReceiveMessage_KMSLocalReplica(t *testing.T) {
+	primary := "arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd"
+	kmsMocks := map[string]*test.KmsMock{
+		"us-east-1": {},
+		"eu-west-1": {},
+	}
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sender := getRegionClient(sqsMock, "us-east-1", kmsMocks, KMSKeyID(primary))
+	receiver := getRegionClient(sqsMock, "eu-west-1", kmsMocks)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 2; i++ {
+		_, err := sender.SendMessage(&testQueue, []byte("TestPayload"))
+		test.AssertNotError(t, err)
+	}
+
+	// The replica in the local region decrypts the data key
+	kmsMocks["eu-west-1"].EncryptionContext = kmsMocks["us-east-1"].EncryptionContext
+	messages, err := receiver.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+	test.AssertEqual(t, kmsMocks["eu-west-1"].DecryptCalledCount, 2)
+	test.AssertEqual(t, kmsMocks["us-east-1"].DecryptCalledCount, 0)
+
+	// Falls back to the region of the key if the local replica fails
+	_, err = sender.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	kmsMocks["eu-west-1"].Err = errors.New("key not found")
+	messages, err = receiver.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+	test.AssertEqual(t, kmsMocks["us-east-1"].DecryptCalledCount, 1)
+}
+
+func TestClient_SendAndReceiveMessage_StaticKeyring(t *testing.T) {
+	keyring, err := NewStaticKeyring(map[string][]byte{"dev": bytes.Repeat([]byte{1}, 32), "test": bytes.Repeat([]byte{2}, 16)})
+	test.AssertNotError(t, err)
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, KMSKeyID("dev"), EncryptionKeyProvider(keyring), EncryptionContextFunc(queueEncryptionContext))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload0"))
+	test.AssertNotError(t, err)
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload1"), MessageKMSKeyID("test"))
+	test.AssertNotError(t, err)
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageKMSKeyID("prod"))
+	test.AssertEqual(t, strings.Contains(err.Error(), ErrorKeyNotFound.Error()), true)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+	test.AssertEqual(t, *messages[0].Body, "TestPayload0")
+	test.AssertEqual(t, *messages[1].Body, "TestPayload1")
+}
+
+func TestStaticKeyring(t *testing.T) {
+	_, err := NewStaticKeyring(map[string][]byte{"dev": {1, 2, 3}})
+	test.AssertEqual(t, err, ErrorInvalidKey)
+
+	file, err := ioutil.TempFile("", "keyring")
+	test.AssertNotError(t, err)
+	defer os.Remove(file.Name())
+
+	keys := `{"dev": "` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)) + `"}`
+	_, err = file.WriteString(keys)
+	test.AssertNotError(t, err)
+	test.AssertNotError(t, file.Close())
+
+	fromFile, err := LoadStaticKeyring(file.Name())
+	test.AssertNotError(t, err)
+
+	test.AssertNotError(t, os.Setenv("KITSUNE_TEST_KEYRING", keys))
+	defer os.Unsetenv("KITSUNE_TEST_KEYRING")
+
+	fromEnv, err := StaticKeyringFromEnv("KITSUNE_TEST_KEYRING")
+	test.AssertNotError(t, err)
+
+	ec := map[string]string{"queue": "test-queue"}
+	dataKey, err := fromFile.GenerateDataKey(context.Background(), "dev", "AES_128", ec)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(dataKey.Plaintext), 16)
+
+	plaintext, err := fromEnv.Decrypt(context.Background(), "dev", dataKey.EncryptedKey, ec)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, string(plaintext), string(dataKey.Plaintext))
+
+	_, err = fromEnv.Decrypt(context.Background(), "dev", dataKey.EncryptedKey, map[string]string{"queue": "other-queue"})
+	assertTamperError(t, err)
+}
+
+// vaultTransitMock emulates the datakey and decrypt endpoints of the transit secrets engine. The ciphertext is the context and
+// the plaintext, which is enough to check that they are passed correctly.
+func vaultTransitMock(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+
+		var req vaultRequest
+		test.AssertNotError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		resp := &vaultResponse{}
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/myKey":
+			resp.Data.Plaintext = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, req.Bits/8))
+			resp.Data.Ciphertext = "vault:v1:" + req.Context + ":" + resp.Data.Plaintext
+		case "/v1/transit/decrypt/myKey":
+			parts := strings.Split(req.Ciphertext, ":")
+			if parts[2] != req.Context {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"errors":["cipher: message authentication failed"]}`)
+				return
+			}
+			resp.Data.Plaintext = parts[3]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+			return
+		}
+
+		test.AssertNotError(t, json.NewEncoder(w).Encode(resp))
+	}))
+}
+
+func TestClient_SendAndReceiveMessage_VaultTransit(t *testing.T) {
+	server := vaultTransitMock(t)
+	defer server.Close()
+
+	sqsMock := test.NewSQSMock(5, int64(10))
+	provider := NewVaultTransitKeyProvider(server.URL, "token")
+	sqsClient := getClient(sqsMock, nil, nil, KMSKeyID("myKey"), EncryptionKeyProvider(provider), EncryptionContextFunc(queueEncryptionContext))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+	test.AssertEqual(t, *messages[0].Body, "TestPayload")
+
+	provider.Token = "wrong"
+	_, err = sqsClient.SendMessage(&testQueue, []byte("TestPayload"))
+	test.AssertIsError(t, err)
+}
+
+func TestVaultTransitKeyProvider_InvalidKeyID(t *testing.T) {
+	server := vaultTransitMock(t)
+	defer server.Close()
+
+	provider := NewVaultTransitKeyProvider(server.URL, "token")
+	for _, keyID := range []string{"", "../../sys/seal", "myKey/../other", "..", "my/key"} {
+		_, err := provider.GenerateDataKey(context.Background(), keyID, "AES_256", nil)
+		test.AssertEqual(t, err, ErrorInvalidVaultKeyID)
+
+		_, err = provider.Decrypt(context.Background(), keyID, []byte("vault:v1::AAAA"), nil)
+		test.AssertEqual(t, err, ErrorInvalidVaultKeyID)
+	}
+
+	// Other characters are escaped and stay within the path segment of the key
+	_, err := provider.Decrypt(context.Background(), "myKey?version=1", []byte("vault:v1::AAAA"), nil)
+	test.AssertIsError(t, err)
+	test.AssertEqual(t, strings.Contains(err.Error(), "404"), true)
+}
+
+func TestClient_DeleteMessageBatch(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(20))
+	sqsMock.InvalidReceiptHandles = map[string]bool{"invalid": true}
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	var receiptHandles []*string
+	for i := 0; i < 12; i++ {
+		receiptHandles = append(receiptHandles, aws.String("receiptHandle"+strconv.Itoa(i)))
+	}
+	receiptHandles[5] = aws.String("invalid")
+
+	errs := sqsClient.DeleteMessageBatch(&testQueue, receiptHandles)
+	test.AssertEqual(t, len(errs), 12)
+	test.AssertEqual(t, sqsMock.DeleteMessageBatchCalledCount, int64(2))
+	for i, err := range errs {
+		if i == 5 {
+			test.AssertIsError(t, err)
+			test.AssertEqual(t, strings.Contains(err.Error(), sqs.ErrCodeReceiptHandleIsInvalid), true)
+		} else {
+			test.AssertNotError(t, err)
+		}
+	}
+
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 11))
+}
+
+func TestClient_ChangeMessageVisibilityBatch(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	messages := []*sqs.Message{
+		{ReceiptHandle: aws.String("receiptHandle0")},
+		{ReceiptHandle: aws.String("receiptHandle1")},
+		{ReceiptHandle: aws.String("receiptHandle2")},
+	}
+
+	errs := sqsClient.ChangeMessageVisibilityBatch(&testQueue, messages, 30)
+	for _, err := range errs {
+		test.AssertNotError(t, err)
+	}
+
+	requests, err := sqsMock.WaitUntilMessageVisibilityChanged(&testQueue, 3)
+	test.AssertNotError(t, err)
+	for i, request := range requests {
+		test.AssertEqual(t, *request.ReceiptHandle, *messages[i].ReceiptHandle)
+		test.AssertEqual(t, *request.VisibilityTimeout, int64(30))
+	}
+}
+
+func TestClient_DeleteMessage_Buffered(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(20))
+	sqsMock.InvalidReceiptHandles = map[string]bool{"invalid": true}
+	sqsClient := getClient(sqsMock, nil, nil, DeleteBufferLinger(50*time.Millisecond))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	errs := make([]error, 15)
+	var wg sync.WaitGroup
+	for i := range errs {
+		receiptHandle := aws.String("receiptHandle" + strconv.Itoa(i))
+		if i == 7 {
+			receiptHandle = aws.String("invalid")
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = sqsClient.DeleteMessage(&testQueue, receiptHandle)
+		}(i)
+	}
+	wg.Wait()
+
+	// The first 10 deletes are sent when the buffer is full and the last 5 when the linger time has passed
+	test.AssertEqual(t, atomic.LoadInt64(&sqsMock.DeleteMessageBatchCalledCount), int64(2))
+	for i, err := range errs {
+		if i == 7 {
+			test.AssertIsError(t, err)
+		} else {
+			test.AssertNotError(t, err)
+		}
+	}
+
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 14))
+}
+
+func TestClient_DeleteMessage_BufferedClose(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, DeleteBufferLinger(time.Hour))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	result := make(chan error)
+	go func() {
+		result <- sqsClient.DeleteMessage(&testQueue, aws.String("receiptHandle"))
+	}()
+
+	// Wait for the delete to be buffered
+	for {
+		b := sqsClient.deletes.get(sqsClient, &testQueue, time.Hour)
+		b.batcher.lock.Lock()
+		pending := len(b.batcher.pending)
+		b.batcher.lock.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close sends the pending deletes without waiting for the linger time
+	test.AssertNotError(t, sqsClient.Close())
+	test.AssertNotError(t, <-result)
+	test.AssertEqual(t, sqsMock.DeleteMessageBatchCalledCount, int64(1))
+
+	// Deletes are no longer buffered after close
+	test.AssertNotError(t, sqsClient.DeleteMessage(&testQueue, aws.String("receiptHandle")))
+	test.AssertEqual(t, sqsMock.DeleteMessageBatchCalledCount, int64(1))
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 2))
+}
+
+func TestBufferedSender(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(20))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	sender := sqsClient.NewBufferedSender(&testQueue, SendBufferLinger(50*time.Millisecond))
+	defer sender.Close()
+
+	futures := make([]*SendFuture, 15)
+	var wg sync.WaitGroup
+	for i := range futures {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			futures[i] = sender.Send([]byte("Testpayload" + strconv.Itoa(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, future := range futures {
+		result, err := future.Result()
+		test.AssertNotError(t, err)
+		test.AssertEqual(t, len(result.MessageID), 36)
+	}
+
+	// The first 10 messages are sent when the batch is full and the last 5 when the linger time has passed
+	test.AssertEqual(t, sqsMock.SendMessageBatchCalls(), 2)
+
+	messages, err := sqsMock.WaitUntilMessagesReceived(&testQueue, 15)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 15)
+}
+
+func TestBufferedSender_MaxBatchBytes(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	sender := sqsClient.NewBufferedSender(&testQueue, SendBufferLinger(time.Hour), SendBufferMaxBatchBytes(30))
+
+	var futures []*SendFuture
+	for i := 0; i < 3; i++ {
+		futures = append(futures, sender.Send([]byte("Testpayload"+strconv.Itoa(i))))
+	}
+
+	// The third message does not fit in the batch with the first two, so they are sent without waiting for the linger time
+	for _, future := range futures[:2] {
+		_, err := future.Result()
+		test.AssertNotError(t, err)
+	}
+
+	sender.Close()
+	_, err := futures[2].Result()
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, sqsMock.SendMessageBatchCalls(), 2)
+}
+
+func TestBufferedSender_CallbackAndClose(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	sender := sqsClient.NewBufferedSender(&testQueue, SendBufferLinger(time.Hour))
+
+	results := make(chan error, 1)
+	sender.SendWithCallback([]byte("Testpayload"), nil, func(result *SendResult, err error) {
+		results <- err
+	})
+
+	// Errors from preparing the message are reported right away
+	invalidAttributes := map[string]*sqs.MessageAttributeValue{
+		"AWS.invalid": {DataType: aws.String("String"), StringValue: aws.String("value")},
+	}
+	_, err := sender.SendWithAttributes([]byte("Testpayload"), invalidAttributes).Result()
+	test.AssertEqual(t, err, ErrorInvalidAttributeName)
+
+	// Close sends the buffered message without waiting for the linger time
+	sender.Close()
+	test.AssertNotError(t, <-results)
+	test.AssertEqual(t, sqsMock.SendMessageBatchCalls(), 1)
+
+	_, err = sender.Send([]byte("Testpayload")).Result()
+	test.AssertEqual(t, err, ErrorBufferedSenderClosed)
+}
+
+func TestBufferedSender_DeletesPayloadOnError(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient, s3Mock := newDeletePayloadsTestClient(sqsMock)
+
+	// The queue does not exist, so the batch fails
+	missingQueue := "missing-queue"
+	sender := sqsClient.NewBufferedSender(&missingQueue, SendBufferLinger(time.Hour))
+
+	future := sender.Send([]byte("Testpayload"), MessageForceS3(true))
+	sender.Flush()
+	_, err := future.Result()
+	test.AssertIsError(t, err)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+
+	sender.Close()
+	_, err = sender.Send([]byte("Testpayload"), MessageForceS3(true)).Result()
+	test.AssertEqual(t, err, ErrorBufferedSenderClosed)
+	test.AssertEqual(t, s3Mock.PutObjectHandlerCalledCount, 2)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 2)
+}
+
+// getSQSEventWithFailingRecord returns an event where the record at index failing has a payload which can't be decompressed.
+func getSQSEventWithFailingRecord(t *testing.T, n int, failing int, eventSourceARN string) events.SQSEvent {
+	var payloads []string
+	for i := 0; i < n; i++ {
+		payloads = append(payloads, "Testpayload"+strconv.Itoa(i))
+	}
+
+	event := getSQSEvent(payloads)
+	for i := range event.Records {
+		event.Records[i].MessageId = "id" + strconv.Itoa(i)
+		event.Records[i].EventSourceARN = eventSourceARN
+	}
+
+	compressed, err := compressData([]byte("Testpayload"), CompressionGzip, DefaultCompressionLevel)
+	test.AssertNotError(t, err)
+
+	event.Records[failing].Body = string(compressed)
+	event.Records[failing].MessageAttributes = map[string]events.SQSMessageAttribute{
+		AttributeCompression: {DataType: "String", StringValue: aws.String("lz4")},
+	}
+
+	return event
+}
+
+func TestClient_ReceiveSQSEventRecords(t *testing.T) {
+	sqsClient := getClient(nil, nil, nil)
+
+	event := getSQSEventWithFailingRecord(t, 3, 1, "arn:aws:sqs:eu-west-1:123456789012:test-queue")
+	failingBody := event.Records[1].Body
+
+	results := sqsClient.ReceiveSQSEventRecords(&event)
+	test.AssertEqual(t, len(results), 3)
+	test.AssertNotError(t, results[0].Err)
+	test.AssertEqual(t, results[1].Err, ErrorUnsupportedCompression)
+	test.AssertEqual(t, results[1].MessageID, "id1")
+	test.AssertNotError(t, results[2].Err)
+
+	// The failing record is left as received
+	test.AssertEqual(t, event.Records[0].Body, "Testpayload0")
+	test.AssertEqual(t, event.Records[1].Body, failingBody)
+	test.AssertEqual(t, len(event.Records[1].MessageAttributes), 1)
+	test.AssertEqual(t, event.Records[2].Body, "Testpayload2")
+
+	_, err := sqsClient.ReceiveSQSEvent(&event)
+	test.AssertEqual(t, err, ErrorUnsupportedCompression)
+}
+
+func TestClient_HandleSQSEvent(t *testing.T) {
+	sqsClient := getClient(nil, nil, nil)
+
+	event := getSQSEventWithFailingRecord(t, 4, 1, "arn:aws:sqs:eu-west-1:123456789012:test-queue")
+
+	var handled []string
+	response := sqsClient.HandleSQSEvent(&event, func(message *events.SQSMessage) error {
+		handled = append(handled, message.Body)
+		if message.Body == "Testpayload2" {
+			return errors.New("handler failed")
+		}
+		return nil
+	})
+
+	test.AssertEqual(t, strings.Join(handled, ","), "Testpayload0,Testpayload2,Testpayload3")
+
+	responseBytes, err := json.Marshal(response)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, string(responseBytes), `{"batchItemFailures":[{"itemIdentifier":"id1"},{"itemIdentifier":"id2"}]}`)
+
+	responseBytes, err = json.Marshal(BatchItemFailures([]RecordResult{{MessageID: "id0"}}))
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, string(responseBytes), `{"batchItemFailures":[]}`)
+}
+
+func TestClient_HandleSQSEvent_FIFO(t *testing.T) {
+	sqsClient := getClient(nil, nil, nil)
+
+	event := getSQSEventWithFailingRecord(t, 4, 1, "arn:aws:sqs:eu-west-1:123456789012:test-queue.fifo")
+
+	var handled []string
+	response := sqsClient.HandleSQSEvent(&event, func(message *events.SQSMessage) error {
+		handled = append(handled, message.Body)
+		return nil
+	})
+
+	// The records after the failing record are not handled, but reported as failed
+	test.AssertEqual(t, strings.Join(handled, ","), "Testpayload0")
+	test.AssertEqual(t, len(response.BatchItemFailures), 3)
+	for i, failure := range response.BatchItemFailures {
+		test.AssertEqual(t, failure.ItemIdentifier, "id"+strconv.Itoa(i+1))
+	}
+}
+
+func TestPayloadRegistry_Expiry(t *testing.T) {
+	now := time.Now()
+	registry := &payloadRegistry{now: func() time.Time { return now }}
+
+	fe := &fileEvent{Bucket: aws.String("test-bucket"), Filename: aws.String("testFile")}
+	registry.put(aws.String("receiptHandle0"), fe)
+	registry.put(aws.String("receiptHandle1"), fe)
+
+	taken, exists := registry.take(aws.String("receiptHandle0"))
+	test.AssertEqual(t, exists, true)
+	test.AssertEqual(t, taken, fe)
+
+	// Expired entries are not returned and are removed when a new entry is put
+	now = now.Add(maxVisibilityPeriod)
+	registry.put(aws.String("receiptHandle2"), fe)
+	test.AssertEqual(t, len(registry.entries), 1)
+
+	_, exists = registry.take(aws.String("receiptHandle1"))
+	test.AssertEqual(t, exists, false)
+}
+
+func TestClient_Backoff_KeepsPayloadOnError(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return &s3.PutObjectOutput{}, nil
+	}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewBufferString("TestPayload")),
+		}, nil
+	}
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		return &s3.DeleteObjectOutput{}, nil
+	}
+	sqsClient := getClient(sqsMock, s3Mock, nil, S3Bucket("test-bucket"), DeleteS3Payloads(true))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageForceS3(true))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+
+	// A failed backoff keeps the payload, so it is deleted with the message
+	test.AssertEqual(t, sqsClient.Backoff(&testQueue, messages[0]), ErrorBackoffFunctionNotSet)
+
+	err = sqsClient.DeleteMessage(&testQueue, messages[0].ReceiptHandle)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+}
+
+func newDeletePayloadsTestClient(sqsMock *test.SQSMock, opt ...ClientOption) (*Client, *test.S3Mock) {
+	s3Mock := &test.S3Mock{}
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		return &s3.PutObjectOutput{}, nil
+	}
+	s3Mock.GetObjectHandler = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return &s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewBufferString("TestPayload")),
+		}, nil
+	}
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		return &s3.DeleteObjectOutput{}, nil
+	}
+
+	return getClient(sqsMock, s3Mock, nil, append([]ClientOption{S3Bucket("test-bucket"), DeleteS3Payloads(true)}, opt...)...), s3Mock
+}
+
+func TestClient_DeleteMessage_BufferedDeletesPayloadAfterCancel(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient, s3Mock := newDeletePayloadsTestClient(sqsMock, DeleteBufferLinger(time.Hour))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageForceS3(true))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+
+	// The caller stops waiting, but the message is still deleted with the batch and so is the payload
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	test.AssertEqual(t, sqsClient.DeleteMessageWithContext(ctx, &testQueue, messages[0].ReceiptHandle), context.Canceled)
+
+	test.AssertNotError(t, sqsClient.Close())
+	test.AssertNotError(t, sqsMock.WaitUntilMessageDeleted(&testQueue, 1))
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+	test.AssertEqual(t, len(sqsClient.payloads.entries), 0)
+}
+
+func TestClient_ChangeMessageVisibilityBatch_StopsHeartbeatAndForgetsPayload(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient, s3Mock := newDeletePayloadsTestClient(sqsMock)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	for i := 0; i < 2; i++ {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageForceS3(true))
+		test.AssertNotError(t, err)
+	}
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 2)
+
+	heartbeat := sqsClient.StartHeartbeat(&testQueue, messages[0], HeartbeatVisibilityTimeout(30), HeartbeatInterval(time.Hour))
+
+	// Extending the visibility keeps the receipt handle valid, so the payload is still deleted with the message
+	errs := sqsClient.ChangeMessageVisibilityBatch(&testQueue, messages[:1], 60)
+	test.AssertNotError(t, errs[0])
+
+	select {
+	case <-heartbeat.Done():
+	default:
+		t.Error("Expected heartbeat to be stopped")
+	}
+	test.AssertEqual(t, len(sqsClient.heartbeats.entries), 0)
+
+	test.AssertNotError(t, sqsClient.DeleteMessage(&testQueue, messages[0].ReceiptHandle))
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+
+	// Making the message visible again forgets the payload
+	errs = sqsClient.ChangeMessageVisibilityBatch(&testQueue, messages[1:], 0)
+	test.AssertNotError(t, errs[0])
+	test.AssertEqual(t, len(sqsClient.payloads.entries), 0)
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 1)
+}
+
+func TestClient_ReceiveMessage_S3BucketNotAllowed(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sender, _ := newDeletePayloadsTestClient(sqsMock, S3Bucket("other-bucket"))
+	receiver, s3Mock := newDeletePayloadsTestClient(sqsMock)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sender.SendMessage(&testQueue, []byte("TestPayload"), MessageForceS3(true))
+	test.AssertNotError(t, err)
+
+	// The receiver only deletes objects in its own bucket, so pointers to other buckets are rejected
+	_, err = receiver.ReceiveMessages(&testQueue)
+	test.AssertEqual(t, err, ErrorS3BucketNotAllowed)
+	test.AssertEqual(t, s3Mock.GetObjectHandlerCalledCount, 0)
+	test.AssertEqual(t, len(receiver.payloads.entries), 0)
+}
+
+func TestClient_DeleteMessage_KeepsPayloadWhenS3DeleteFails(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient, s3Mock := newDeletePayloadsTestClient(sqsMock)
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageForceS3(true))
+	test.AssertNotError(t, err)
+
+	messages, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(messages), 1)
+
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		return nil, errors.New("delete failed")
+	}
+	test.AssertIsError(t, sqsClient.DeleteMessage(&testQueue, messages[0].ReceiptHandle))
+
+	// The location is kept so the delete can be retried
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		return &s3.DeleteObjectOutput{}, nil
+	}
+	test.AssertNotError(t, sqsClient.DeletePayload(messages[0]))
+	test.AssertEqual(t, s3Mock.DeleteObjectHandlerCalledCount, 2)
+	test.AssertEqual(t, len(sqsClient.payloads.entries), 0)
+}
+
+func TestClient_SendMessage_DeletesPayloadOnError(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient, s3Mock := newDeletePayloadsTestClient(sqsMock)
+
+	var uploaded, deleted []string
+	s3Mock.PutObjectHandler = func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		uploaded = append(uploaded, *input.Key)
+		return &s3.PutObjectOutput{}, nil
+	}
+	s3Mock.DeleteObjectHandler = func(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+		deleted = append(deleted, *input.Key)
+		return &s3.DeleteObjectOutput{}, nil
+	}
+
+	// The queue does not exist, so the messages are never put on the queue
+	missingQueue := "missing-queue"
+	_, err := sqsClient.SendMessage(&missingQueue, []byte("TestPayload"), MessageForceS3(true))
+	test.AssertIsError(t, err)
+
+	results := sqsClient.SendMessageBatch(&missingQueue, []BatchEntry{
+		{ID: "0", Payload: []byte("TestPayload0"), Options: []SendOption{MessageForceS3(true)}},
+		{ID: "1", Payload: []byte("TestPayload1"), Options: []SendOption{MessageForceS3(true)}},
+	})
+	for _, result := range results {
+		test.AssertIsError(t, result.Err)
+	}
+
+	test.AssertEqual(t, len(uploaded), 3)
+	test.AssertEqual(t, strings.Join(deleted, ","), strings.Join(uploaded, ","))
+}
+
+func TestClient_SendMessage_CompressionLevelPerAlgorithm(t *testing.T) {
+	sqsMock := test.NewSQSMock(5, int64(10))
+	sqsClient := getClient(sqsMock, nil, nil, Compression(CompressionGzip), CompressionLevel(9), CompressionLevelFor(CompressionBrotli, 2))
+
+	testQueue := "test-queue"
+	sqsMock.CreateQueueIfNotExists(&testQueue)
+
+	test.AssertEqual(t, sqsClient.opts.compressionLevelFor(CompressionGzip), 9)
+	test.AssertEqual(t, sqsClient.opts.compressionLevelFor(CompressionZstd), DefaultCompressionLevel)
+	test.AssertEqual(t, sqsClient.opts.compressionLevelFor(CompressionBrotli), 2)
+
+	// Level 9 is not valid for zstd, so the default level of zstd is used
+	for _, a := range []CompressionAlgorithm{CompressionGzip, CompressionZstd, CompressionBrotli} {
+		_, err := sqsClient.SendMessage(&testQueue, []byte("TestPayload"), MessageCompression(a))
+		test.AssertNotError(t, err)
+	}
+
+	received, err := sqsClient.ReceiveMessages(&testQueue)
+	test.AssertNotError(t, err)
+	test.AssertEqual(t, len(received), 3)
+	for _, message := range received {
+		test.AssertEqual(t, *message.Body, "TestPayload")
+	}
+}
+
+func TestDecompress_MaxDecompressedSize(t *testing.T) {
+	payload := make([]byte, 100000)
+
+	for _, a := range []CompressionAlgorithm{CompressionGzip, CompressionDeflate, CompressionZstd, CompressionSnappy, CompressionBrotli} {
+		compressed, err := compress(payload, a, DefaultCompressionLevel)
+		test.AssertNotError(t, err)
+
+		decompressed, err := decompress(compressed, string(a), int64(len(payload)))
+		test.AssertNotError(t, err)
+		test.AssertEqual(t, len(decompressed), len(payload))
+
+		_, err = decompress(compressed, string(a), int64(len(payload)-1))
+		test.AssertEqual(t, err, ErrorMaxDecompressedSizeExceeded)
+	}
+}
+
+func TestCompressionEnabled_Precedence(t *testing.T) {
+	optionSets := []struct {
+		opts    []ClientOption
+		enabled bool
+	}{
+		{[]ClientOption{Compression(CompressionZstd)}, true},
+		{[]ClientOption{CompressionThreshold(100)}, true},
+		{[]ClientOption{CompressionEnabled(false), Compression(CompressionZstd)}, false},
+		{[]ClientOption{Compression(CompressionZstd), CompressionEnabled(false)}, false},
+		{[]ClientOption{CompressionEnabled(false), CompressionThreshold(100)}, false},
+		{[]ClientOption{CompressionEnabled(true)}, true},
+	}
+
+	for _, optionSet := range optionSets {
+		sqsClient := getClient(nil, nil, nil, optionSet.opts...)
+		test.AssertEqual(t, sqsClient.opts.compressionEnabled, optionSet.enabled)
+	}
+}
@@ -5,198 +5,216 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/kms"
-	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"io"
-	"sync"
-	"time"
 )
 
+// encryptedEvent is the envelope holding an encrypted payload. Version, Algorithm, KeySpec and Nonce are not set in the legacy
+// version of the envelope, where the payload is encrypted with AES_256_GCM and the nonce is prepended to the payload. KeyID is
+// the id of the key used to encrypt the data key, eg. the ARN of a KMS key.
 type encryptedEvent struct {
-	EncryptedEncryptionKey []byte `json:"encryptedEncryptionKey"`
-	KeyID                  string `json:"keyId"`
-	Payload                []byte `json:"payload"`
+	Version                 int               `json:"version,omitempty"`
+	Algorithm               Algorithm         `json:"algorithm,omitempty"`
+	KeySpec                 string            `json:"keySpec,omitempty"`
+	EncryptedEncryptionKey  []byte            `json:"encryptedEncryptionKey"`
+	KeyID                   string            `json:"keyId"`
+	EncryptionContext       map[string]string `json:"encryptionContext,omitempty"`
+	Authenticated           bool              `json:"authenticated,omitempty"`
+	AuthenticatedAttributes []string          `json:"authenticatedAttributes,omitempty"`
+	Nonce                   []byte            `json:"nonce,omitempty"`
+	Payload                 []byte            `json:"payload"`
 }
 
-type keyCache struct {
-	entries          map[[16]byte]cacheEntry
-	expirationPeriod time.Duration
-	rwLock           sync.RWMutex
-}
-
-type cacheEntry struct {
-	plainText  []byte
-	cipherText []byte
-	entered    time.Time
+// kmsClient encrypts and decrypts payloads using data keys from the key provider. Data keys are cached if enabled.
+type kmsClient struct {
+	opts     *options
+	cache    *keyCache
+	provider KeyProvider
 }
 
-func (kc *keyCache) put(key [16]byte, plainText []byte, cipherText []byte) {
-	kc.clean()
-
-	kc.rwLock.Lock()
-	defer kc.rwLock.Unlock()
+func newKMSClient(provider KeyProvider, opts *options) *kmsClient {
+	var cache *keyCache
+	if opts.kmsKeyCacheEnabled {
+		cache = newKeyCache(opts)
+	}
 
-	kc.entries[key] = cacheEntry{
-		plainText:  plainText,
-		cipherText: cipherText,
-		entered:    time.Now(),
+	return &kmsClient{
+		opts:     opts,
+		cache:    cache,
+		provider: provider,
 	}
 }
 
-func (kc *keyCache) get(key [16]byte) (cacheEntry, bool) {
-	kc.clean()
-
-	kc.rwLock.RLock()
-	defer kc.rwLock.RUnlock()
-
-	entry, exists := kc.entries[key]
-	return entry, exists
+// close empties the key cache.
+func (k *kmsClient) close() {
+	if k.cache != nil {
+		k.cache.close()
+	}
 }
 
-func (kc *keyCache) clean() {
-	kc.rwLock.Lock()
-	defer kc.rwLock.Unlock()
+// encrypt encrypts the payload with a new data key and sets the key and the encrypted payload on the event. The version,
+// algorithm and encryption context of the event has to be set. The encryption context is passed to the key provider. The
+// payload is bound to the additional data of the event, looking up attributes using attribute. The keys are tried in order, and
+// the id of the key used is returned.
+func (k *kmsClient) encrypt(ctx aws.Context, keyIDs []string, payload []byte, ee *encryptedEvent, attribute func(string) (string, bool)) (string, error) {
+	algorithm := ee.algorithm()
+	spec, exists := algorithms[algorithm]
+	if !exists {
+		return "", ErrorUnsupportedAlgorithm
+	}
 
-	for key, value := range kc.entries {
-		if value.entered.Add(kc.expirationPeriod).Before(time.Now()) {
-			delete(kc.entries, key)
-		}
+	dataKey, keyID, err := k.generateDataKeyWithFailover(ctx, keyIDs, spec.keySpec, ee.EncryptionContext, len(payload))
+	if err != nil {
+		return "", err
 	}
-}
+	defer zero(dataKey.Plaintext)
 
-type kmsClient struct {
-	opts   *options
-	cache  *keyCache
-	awsKMS kmsiface.KMSAPI
-}
+	ee.EncryptedEncryptionKey = dataKey.EncryptedKey
+	ee.KeyID = dataKey.KeyID
 
-func newKMSClient(awsKMS kmsiface.KMSAPI, opts *options) *kmsClient {
-	var cache *keyCache
-	if opts.kmsKeyCacheEnabled {
-		cache = &keyCache{
-			entries:          make(map[[16]byte]cacheEntry),
-			expirationPeriod: opts.kmsKeyCacheExpirationPeriod,
-		}
+	nonce, ciphertext, err := sealData(algorithm, payload, dataKey.Plaintext, ee.additionalData(attribute))
+	if err != nil {
+		return "", err
 	}
 
-	return &kmsClient{
-		opts:   opts,
-		cache:  cache,
-		awsKMS: awsKMS,
+	if ee.Version == EnvelopeVersionLegacy {
+		ee.Payload = append(nonce, ciphertext...)
+	} else {
+		ee.KeySpec = spec.keySpec
+		ee.Nonce = nonce
+		ee.Payload = ciphertext
 	}
+
+	return keyID, nil
 }
 
-func (k *kmsClient) encrypt(keyID *string, payload []byte) (*encryptedEvent, error) {
-	gki := &kms.GenerateDataKeyInput{
-		KeyId:   keyID,
-		KeySpec: aws.String(kms.DataKeySpecAes256),
-	}
+// generateDataKeyWithFailover tries to generate a data key with each of the keys in order. Returns the data key from the first
+// key that succeeds together with the id of that key, or the error from the last key if all fail.
+func (k *kmsClient) generateDataKeyWithFailover(ctx aws.Context, keyIDs []string, keySpec string, encryptionContext map[string]string, n int) (*DataKey, string, error) {
+	var err error
+	for _, keyID := range keyIDs {
+		var dataKey *DataKey
+		if dataKey, err = k.generateDataKey(ctx, keyID, keySpec, encryptionContext, n); err == nil {
+			return dataKey, keyID, nil
+		}
 
-	gko, err := k.generateDataKey(gki)
-	if err != nil {
-		return nil, err
+		// No point in trying the next key if the context is done
+		if ctx.Err() != nil {
+			return nil, "", err
+		}
 	}
 
-	encryptedPayload, err := encryptData(payload, gko.Plaintext)
-
-	encryptedEvent := &encryptedEvent{
-		EncryptedEncryptionKey: gko.CiphertextBlob,
-		KeyID:                  *gko.KeyId,
-		Payload:                encryptedPayload,
-	}
+	return nil, "", err
+}
 
-	return encryptedEvent, err
+// cacheKey returns the key of a data key in the cache. The encryption context is part of the key since a data key generated with
+// one encryption context can only be decrypted using the same encryption context.
+func cacheKey(id []byte, encryptionContext map[string]string) [16]byte {
+	return md5.Sum(append(append([]byte(nil), id...), encryptionContextAAD(encryptionContext)...))
 }
 
-func (k *kmsClient) generateDataKey(gki *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+// generateDataKey returns a data key for encrypting a payload of n bytes. A cached key is used if it is within its limits.
+func (k *kmsClient) generateDataKey(ctx aws.Context, keyID string, keySpec string, encryptionContext map[string]string, n int) (*DataKey, error) {
 	if k.cache != nil {
-		if entry, exists := k.cache.get(md5.Sum([]byte(*gki.KeyId))); exists {
-			return &kms.GenerateDataKeyOutput{
-				CiphertextBlob: entry.cipherText,
-				KeyId:          gki.KeyId,
-				Plaintext:      entry.plainText,
+		if entry, exists := k.cache.use(cacheKey([]byte(keyID+"/"+keySpec), encryptionContext), n); exists {
+			return &DataKey{
+				KeyID:        entry.keyID,
+				Plaintext:    entry.plainText,
+				EncryptedKey: entry.cipherText,
 			}, nil
 		}
 	}
 
-	gko, err := k.awsKMS.GenerateDataKey(gki)
-	if k.opts.kmsKeyCacheEnabled && err == nil {
+	dataKey, err := k.provider.GenerateDataKey(ctx, keyID, keySpec, encryptionContext)
+	if k.cache != nil && err == nil {
 		// Put with both key name and ciphertext so it wont need to get its own key for decryption
-		k.cache.put(md5.Sum([]byte(*gki.KeyId)), gko.Plaintext, gko.CiphertextBlob)
-		k.cache.put(md5.Sum(gko.CiphertextBlob), gko.Plaintext, gko.CiphertextBlob)
+		k.cache.putUsed(cacheKey([]byte(keyID+"/"+keySpec), encryptionContext), dataKey.KeyID, dataKey.Plaintext, dataKey.EncryptedKey, n)
+		k.cache.put(cacheKey(dataKey.EncryptedKey, encryptionContext), dataKey.KeyID, dataKey.Plaintext, dataKey.EncryptedKey)
 	}
 
-	return gko, err
+	return dataKey, err
 }
 
-func (k *kmsClient) decrypt(ee *encryptedEvent) ([]byte, error) {
-	di := &kms.DecryptInput{
-		CiphertextBlob: ee.EncryptedEncryptionKey,
+func (k *kmsClient) decrypt(ctx aws.Context, ee *encryptedEvent, attribute func(string) (string, bool)) ([]byte, error) {
+	plaintextKey, err := k.fetchKey(ctx, ee.KeyID, ee.EncryptedEncryptionKey, ee.EncryptionContext)
+	if err != nil {
+		return nil, err
 	}
+	defer zero(plaintextKey)
 
-	do, err := k.fetchKey(di)
+	nonce, ciphertext, err := ee.splitPayload()
 	if err != nil {
 		return nil, err
 	}
 
-	return decryptData(ee.Payload, do.Plaintext)
+	return openData(ee.algorithm(), nonce, ciphertext, plaintextKey, ee.additionalData(attribute))
 }
 
-func (k *kmsClient) fetchKey(di *kms.DecryptInput) (*kms.DecryptOutput, error) {
+func (k *kmsClient) fetchKey(ctx aws.Context, keyID string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
 	if k.cache != nil {
-		if entry, exists := k.cache.get(md5.Sum(di.CiphertextBlob)); exists {
-			return &kms.DecryptOutput{
-				Plaintext: entry.plainText,
-			}, nil
+		if entry, exists := k.cache.get(cacheKey(encryptedKey, encryptionContext)); exists {
+			return entry.plainText, nil
 		}
 	}
 
-	do, err := k.awsKMS.Decrypt(di)
-	if k.opts.kmsKeyCacheEnabled && err == nil {
-		k.cache.put(md5.Sum(di.CiphertextBlob), do.Plaintext, di.CiphertextBlob)
+	plaintextKey, err := k.provider.Decrypt(ctx, keyID, encryptedKey, encryptionContext)
+	if k.cache != nil && err == nil {
+		k.cache.put(cacheKey(encryptedKey, encryptionContext), keyID, plaintextKey, encryptedKey)
 	}
 
-	return do, err
+	return plaintextKey, err
 }
 
-func encryptData(data []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// sealData encrypts the data with the key using the algorithm. Returns the generated nonce and the ciphertext.
+func sealData(algorithm Algorithm, data []byte, key []byte, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(algorithm, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, aead.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return nonce, aead.Seal(nil, nonce, data, additionalData), nil
 }
 
-func decryptData(data []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// openData decrypts and authenticates the ciphertext. A TamperError is returned if authentication fails.
+func openData(algorithm Algorithm, nonce []byte, ciphertext []byte, key []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(algorithm, key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	if len(nonce) != aead.NonceSize() || len(ciphertext) < aead.Overhead() {
+		return nil, &TamperError{Reason: "encrypted payload is too short"}
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
-		return nil, err
+		return nil, &TamperError{Reason: err.Error()}
 	}
 
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	return plaintext, nil
+}
+
+// newAEAD returns the cipher for the algorithm. The length of the key has to match the key spec of the algorithm.
+func newAEAD(algorithm Algorithm, key []byte) (cipher.AEAD, error) {
+	spec, exists := algorithms[algorithm]
+	if !exists {
+		return nil, ErrorUnsupportedAlgorithm
+	}
+
+	if len(key) != spec.keySize {
+		return nil, fmt.Errorf("data key is %d bytes, expected %d bytes for %s", len(key), spec.keySize, algorithm)
+	}
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return plaintext, nil
+	return cipher.NewGCM(block)
 }
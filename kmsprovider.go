@@ -0,0 +1,129 @@
+package kitsune
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"strings"
+	"sync"
+)
+
+// KMSFailoverKeyIDs sets keys used for encryption when generating a data key with the key set by KMSKeyID fails, eg. during an
+// outage of KMS in the region of the key. The keys are tried in order. Use the ARNs of multi-region replica keys so receivers can
+// decrypt using the replica in their own region. Key ARNs from other regions are called in the region of the key.
+func KMSFailoverKeyIDs(ids ...string) ClientOption {
+	return func(o *options) { o.kmsFailoverKeyIDs = ids }
+}
+
+// KMSKeyProvider is a KeyProvider generating and decrypting data keys using AWS KMS. Default key provider of the client. Keys
+// are KMS key ids, ARNs or aliases.
+type KMSKeyProvider struct {
+	awsKMS kmsiface.KMSAPI
+
+	// The region of awsKMS. Keys from other regions are called using a client for their region, created by newRegionClient
+	region          string
+	newRegionClient func(region string) kmsiface.KMSAPI
+	regionClients   map[string]kmsiface.KMSAPI
+	lock            sync.Mutex
+}
+
+// NewKMSKeyProvider returns a KMSKeyProvider calling KMS in the region of the session. Key ARNs from other regions are called in
+// the region of the key.
+func NewKMSKeyProvider(awsSession *session.Session) *KMSKeyProvider {
+	return &KMSKeyProvider{
+		awsKMS: kms.New(awsSession),
+		region: aws.StringValue(awsSession.Config.Region),
+		newRegionClient: func(region string) kmsiface.KMSAPI {
+			return kms.New(awsSession, aws.NewConfig().WithRegion(region))
+		},
+	}
+}
+
+// GenerateDataKey generates a data key using KMS. The KeyID of the data key is the ARN of the KMS key.
+func (p *KMSKeyProvider) GenerateDataKey(ctx aws.Context, keyID string, keySpec string, encryptionContext map[string]string) (*DataKey, error) {
+	gki := &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(keySpec),
+	}
+
+	if len(encryptionContext) > 0 {
+		gki.EncryptionContext = aws.StringMap(encryptionContext)
+	}
+
+	region, _ := parseKeyARN(keyID)
+	gko, err := p.regionClient(region).GenerateDataKeyWithContext(ctx, gki)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyID:        aws.StringValue(gko.KeyId),
+		Plaintext:    gko.Plaintext,
+		EncryptedKey: gko.CiphertextBlob,
+	}, nil
+}
+
+// Decrypt decrypts the data key using KMS in the region of the key which encrypted it. A multi-region key from another region is
+// first decrypted using the replica in the local region, falling back to the region of the key.
+func (p *KMSKeyProvider) Decrypt(ctx aws.Context, keyID string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	di := &kms.DecryptInput{
+		CiphertextBlob: encryptedKey,
+	}
+
+	if len(encryptionContext) > 0 {
+		di.EncryptionContext = aws.StringMap(encryptionContext)
+	}
+
+	region, multiRegion := parseKeyARN(keyID)
+	if region != "" && region != p.region && multiRegion {
+		do, err := p.awsKMS.DecryptWithContext(ctx, di)
+		if err == nil || ctx.Err() != nil {
+			return plaintext(do), err
+		}
+	}
+
+	do, err := p.regionClient(region).DecryptWithContext(ctx, di)
+	return plaintext(do), err
+}
+
+func plaintext(do *kms.DecryptOutput) []byte {
+	if do == nil {
+		return nil
+	}
+
+	return do.Plaintext
+}
+
+// regionClient returns the KMS client for the region. Clients for other regions than the local one are created when first used.
+func (p *KMSKeyProvider) regionClient(region string) kmsiface.KMSAPI {
+	if region == "" || region == p.region || p.newRegionClient == nil {
+		return p.awsKMS
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if client, exists := p.regionClients[region]; exists {
+		return client
+	}
+
+	if p.regionClients == nil {
+		p.regionClients = make(map[string]kmsiface.KMSAPI)
+	}
+
+	client := p.newRegionClient(region)
+	p.regionClients[region] = client
+	return client
+}
+
+// parseKeyARN returns the region of a KMS key ARN, eg. arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd, and whether it is a
+// multi-region key. The region is empty for key ids and aliases which are not ARNs.
+func parseKeyARN(keyID string) (string, bool) {
+	parts := strings.SplitN(keyID, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "kms" {
+		return "", false
+	}
+
+	return parts[3], strings.HasPrefix(parts[5], "key/mrk-")
+}
@@ -0,0 +1,93 @@
+package kitsune
+
+import (
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ErrorPreviousRecordFailed is reported for records from a FIFO queue which are not handled because a previous record in the
+// event failed. Lambda has to retry them to keep the order of the messages.
+var ErrorPreviousRecordFailed = errors.New("record not handled because a previous record from the FIFO queue failed")
+
+// RecordResult is the outcome of unpacking or handling a single record of a Lambda SQSEvent. Err is nil if the record succeeded.
+type RecordResult struct {
+	MessageID string
+	Err       error
+}
+
+// SQSEventResponse is the response of a Lambda handler with ReportBatchItemFailures enabled on the event source mapping. Only the
+// records listed in BatchItemFailures are retried by Lambda. Marshals to the format expected by Lambda.
+type SQSEventResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+// SQSBatchItemFailure identifies a failed record by its message id.
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// ReceiveSQSEventRecords unpacks payloads in a Lambda SQSEvent like ReceiveSQSEvent, but does not stop on the first failing
+// record. The returned results are in the same order as the records. Records which fail are left as received.
+func (c *Client) ReceiveSQSEventRecords(event *events.SQSEvent) []RecordResult {
+	return c.ReceiveSQSEventRecordsWithContext(aws.BackgroundContext(), event)
+}
+
+// ReceiveSQSEventRecordsWithContext is the same as ReceiveSQSEventRecords with the addition of a context. Pass the context given
+// to the Lambda handler to respect the Lambda deadline when fetching from S3 and decrypting with KMS.
+func (c *Client) ReceiveSQSEventRecordsWithContext(ctx aws.Context, event *events.SQSEvent) []RecordResult {
+	results := make([]RecordResult, len(event.Records))
+	for i := range event.Records {
+		results[i].MessageID = event.Records[i].MessageId
+		results[i].Err = c.decodeRecord(ctx, &event.Records[i])
+	}
+
+	return results
+}
+
+// HandleSQSEvent unpacks every record of a Lambda SQSEvent and passes it to the handler. Records which can't be unpacked or
+// where the handler returns an error are reported in the response, so only those are retried by Lambda. For FIFO queues the
+// records following a failed record are not handled, but reported as failed as well to keep the order of the messages. Return
+// the response from the Lambda handler and enable ReportBatchItemFailures on the event source mapping.
+func (c *Client) HandleSQSEvent(event *events.SQSEvent, handler func(*events.SQSMessage) error) SQSEventResponse {
+	return c.HandleSQSEventWithContext(aws.BackgroundContext(), event, handler)
+}
+
+// HandleSQSEventWithContext is the same as HandleSQSEvent with the addition of a context. Pass the context given to the Lambda
+// handler to respect the Lambda deadline when fetching from S3 and decrypting with KMS.
+func (c *Client) HandleSQSEventWithContext(ctx aws.Context, event *events.SQSEvent, handler func(*events.SQSMessage) error) SQSEventResponse {
+	results := make([]RecordResult, len(event.Records))
+
+	failed := false
+	for i := range event.Records {
+		record := &event.Records[i]
+		results[i].MessageID = record.MessageId
+
+		if failed && isFIFOQueue(&record.EventSourceARN) {
+			results[i].Err = ErrorPreviousRecordFailed
+			continue
+		}
+
+		if err := c.decodeRecord(ctx, record); err != nil {
+			results[i].Err = err
+		} else {
+			results[i].Err = handler(record)
+		}
+
+		failed = failed || results[i].Err != nil
+	}
+
+	return BatchItemFailures(results)
+}
+
+// BatchItemFailures builds the response reporting the failed records to Lambda.
+func BatchItemFailures(results []RecordResult) SQSEventResponse {
+	response := SQSEventResponse{BatchItemFailures: []SQSBatchItemFailure{}}
+	for _, result := range results {
+		if result.Err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: result.MessageID})
+		}
+	}
+
+	return response
+}
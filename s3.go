@@ -2,11 +2,25 @@ package kitsune
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/google/uuid"
 	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrorInvalidS3Pointer is returned when a message is marked as having its payload in S3, but the body is not a valid pointer.
+	ErrorInvalidS3Pointer = errors.New("invalid S3 pointer in message body")
+
+	// ErrorS3BucketNotAllowed is returned when DeleteS3Payloads is enabled and the payload of a message is in another bucket than
+	// the one configured on the client. Anyone who can send to the queue controls the pointer, so only objects in the configured
+	// bucket are deleted.
+	ErrorS3BucketNotAllowed = errors.New("S3 pointer refers to another bucket than the configured bucket")
 )
 
 type fileEvent struct {
@@ -25,7 +39,7 @@ func newS3Client(awsS3 s3iface.S3API) *s3Client {
 	}
 }
 
-func (s *s3Client) putObject(bucket *string, payload []byte) (*fileEvent, error) {
+func (s *s3Client) putObject(ctx aws.Context, bucket *string, payload []byte) (*fileEvent, error) {
 	key := uuid.New().String()
 	poi := &s3.PutObjectInput{
 		Body:   bytes.NewReader(payload),
@@ -39,18 +53,28 @@ func (s *s3Client) putObject(bucket *string, payload []byte) (*fileEvent, error)
 		Filename: &key,
 	}
 
-	_, err := s.awsS3.PutObject(poi)
+	_, err := s.awsS3.PutObjectWithContext(ctx, poi)
 
 	return fe, err
 }
 
-func (s *s3Client) getObject(fe *fileEvent) ([]byte, error) {
+func (s *s3Client) deleteObject(ctx aws.Context, fe *fileEvent) error {
+	doi := &s3.DeleteObjectInput{
+		Bucket: fe.Bucket,
+		Key:    fe.Filename,
+	}
+
+	_, err := s.awsS3.DeleteObjectWithContext(ctx, doi)
+	return err
+}
+
+func (s *s3Client) getObject(ctx aws.Context, fe *fileEvent) ([]byte, error) {
 	goi := &s3.GetObjectInput{
 		Bucket: fe.Bucket,
 		Key:    fe.Filename,
 	}
 
-	goo, err := s.awsS3.GetObject(goi)
+	goo, err := s.awsS3.GetObjectWithContext(ctx, goi)
 	if err != nil {
 		return nil, err
 	}
@@ -59,3 +83,167 @@ func (s *s3Client) getObject(fe *fileEvent) ([]byte, error) {
 	payload, err := ioutil.ReadAll(goo.Body)
 	return payload, err
 }
+
+// How often expired entries are removed from the payloadRegistry.
+const payloadRegistryPruneInterval = time.Minute
+
+// payloadRegistry keeps track of where the payloads of received messages are located in S3. Entries are keyed by receipt handle.
+// Entries expire after maxVisibilityPeriod, since the receipt handle of a message which is neither deleted nor backed off by then
+// can no longer be used. Expired entries are removed when new entries are put.
+type payloadRegistry struct {
+	entries   map[string]*payloadEntry
+	lastPrune time.Time
+	now       func() time.Time
+	lock      sync.Mutex
+}
+
+type payloadEntry struct {
+	fe      *fileEvent
+	expires time.Time
+}
+
+func (p *payloadRegistry) put(receiptHandle *string, fe *fileEvent) {
+	if receiptHandle == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.entries == nil {
+		p.entries = make(map[string]*payloadEntry)
+	}
+
+	now := p.time()
+	if now.Sub(p.lastPrune) >= payloadRegistryPruneInterval {
+		p.prune(now)
+	}
+
+	p.entries[*receiptHandle] = &payloadEntry{fe: fe, expires: now.Add(maxVisibilityPeriod)}
+}
+
+// take returns the entry for the receipt handle and removes it from the registry. Expired entries are not returned.
+func (p *payloadRegistry) take(receiptHandle *string) (*fileEvent, bool) {
+	if receiptHandle == nil {
+		return nil, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, exists := p.entries[*receiptHandle]
+	if !exists {
+		return nil, false
+	}
+
+	delete(p.entries, *receiptHandle)
+	if !p.time().Before(entry.expires) {
+		return nil, false
+	}
+
+	return entry.fe, true
+}
+
+// prune removes expired entries. Must be called with the lock held.
+func (p *payloadRegistry) prune(now time.Time) {
+	for receiptHandle, entry := range p.entries {
+		if !now.Before(entry.expires) {
+			delete(p.entries, receiptHandle)
+		}
+	}
+
+	p.lastPrune = now
+}
+
+func (p *payloadRegistry) time() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+
+	return time.Now()
+}
+
+// PointerFormat determines how a message points to a payload uploaded to S3.
+type PointerFormat int
+
+const (
+	// PointerFormatKitsune puts a file event in the message body and marks the message with the payloadBucket attribute.
+	PointerFormatKitsune PointerFormat = iota
+
+	// PointerFormatJava is compatible with the AWS Java Extended Client Library (amazon-sqs-java-extended-client-lib). Puts a
+	// PayloadS3Pointer in the message body and marks the message with the ExtendedPayloadSize attribute.
+	PointerFormatJava
+)
+
+const (
+	// AttributeNameExtendedPayloadSize is used by the Java Extended Client Library to mark messages with payload in S3. The value
+	// is the size of the payload.
+	AttributeNameExtendedPayloadSize = "ExtendedPayloadSize"
+
+	// AttributeNameLegacyPayloadSize is used by older versions of the Java Extended Client Library in the same way as
+	// AttributeNameExtendedPayloadSize.
+	AttributeNameLegacyPayloadSize = "SQSLargePayloadSize"
+)
+
+const (
+	javaPointerClass       = "software.amazon.payloadoffloading.PayloadS3Pointer"
+	javaLegacyPointerClass = "com.amazon.sqs.javamessaging.MessageS3Pointer"
+)
+
+// pointerAttributeNames are the attributes used to mark a message with payload in S3 for all the supported formats.
+var pointerAttributeNames = []string{AttributeNameS3Bucket, AttributeNameExtendedPayloadSize, AttributeNameLegacyPayloadSize}
+
+type javaS3Pointer struct {
+	S3BucketName string `json:"s3BucketName"`
+	S3Key        string `json:"s3Key"`
+}
+
+// pointerFormatOf returns the format of the S3 pointer in a message body based on which attributes the message has. Returns
+// false if the message does not point to a payload in S3.
+func pointerFormatOf(hasAttribute func(string) bool) (PointerFormat, bool) {
+	if hasAttribute(AttributeNameS3Bucket) {
+		return PointerFormatKitsune, true
+	}
+
+	if hasAttribute(AttributeNameExtendedPayloadSize) || hasAttribute(AttributeNameLegacyPayloadSize) {
+		return PointerFormatJava, true
+	}
+
+	return PointerFormatKitsune, false
+}
+
+func marshalPointer(fe *fileEvent, format PointerFormat) ([]byte, error) {
+	if format == PointerFormatJava {
+		return json.Marshal([]interface{}{javaPointerClass, javaS3Pointer{S3BucketName: *fe.Bucket, S3Key: *fe.Filename}})
+	}
+
+	return json.Marshal(fe)
+}
+
+func unmarshalPointer(body []byte, format PointerFormat) (*fileEvent, error) {
+	if format == PointerFormatJava {
+		var parts []json.RawMessage
+		if err := json.Unmarshal(body, &parts); err != nil {
+			return nil, err
+		}
+
+		var class string
+		if len(parts) != 2 || json.Unmarshal(parts[0], &class) != nil || (class != javaPointerClass && class != javaLegacyPointerClass) {
+			return nil, ErrorInvalidS3Pointer
+		}
+
+		var jp javaS3Pointer
+		if err := json.Unmarshal(parts[1], &jp); err != nil {
+			return nil, err
+		}
+
+		return &fileEvent{Bucket: &jp.S3BucketName, Filename: &jp.S3Key}, nil
+	}
+
+	var fe fileEvent
+	if err := json.Unmarshal(body, &fe); err != nil {
+		return nil, err
+	}
+
+	return &fe, nil
+}
@@ -0,0 +1,224 @@
+package kitsune
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"time"
+)
+
+// ErrorBufferedSenderClosed is returned for messages sent with a BufferedSender after it has been closed.
+var ErrorBufferedSenderClosed = errors.New("buffered sender is closed")
+
+// BufferedSender collects messages sent to a queue from any number of goroutines and sends them with SendMessageBatch. A batch is
+// sent when it is full, when the next message would make it exceed the max batch size in bytes, or when the first message of the
+// batch has waited for the linger time. Each message goes through the pipeline and upload to S3 when it is sent, so those errors
+// are reported right away. The result of each message is returned with a SendFuture or passed to a callback. Messages sent from
+// different goroutines are not guaranteed to be put on the queue in any particular order, so don't use it for FIFO queues where
+// order matters. Payloads uploaded to S3 for messages which are not put on the queue are deleted.
+type BufferedSender struct {
+	opts bufferedSenderOptions
+
+	client    *Client
+	queueName *string
+	batcher   *batcher[*pendingSend]
+}
+
+type bufferedSenderOptions struct {
+	linger        time.Duration
+	maxBatchSize  int
+	maxBatchBytes int
+}
+
+// BufferedSenderOption sets configuration options for a BufferedSender.
+type BufferedSenderOption func(*bufferedSenderOptions)
+
+// SendBufferLinger sets how long the first message of a batch waits for more messages before the batch is sent. Default is 200ms.
+func SendBufferLinger(d time.Duration) BufferedSenderOption {
+	return func(o *bufferedSenderOptions) { o.linger = d }
+}
+
+// SendBufferMaxBatchSize sets the max number of messages in a batch. Range is 1 - 10. Default is 10.
+func SendBufferMaxBatchSize(n int) BufferedSenderOption {
+	return func(o *bufferedSenderOptions) { o.maxBatchSize = n }
+}
+
+// SendBufferMaxBatchBytes sets the max combined size of the messages in a batch, as calculated by SQS. Can't exceed 256KB, which
+// is the default.
+func SendBufferMaxBatchBytes(n int) BufferedSenderOption {
+	return func(o *bufferedSenderOptions) { o.maxBatchBytes = n }
+}
+
+// SendFuture is the result of a message sent with a BufferedSender. The result is available when the batch containing the
+// message has been sent.
+type SendFuture struct {
+	result   *SendResult
+	err      error
+	done     chan struct{}
+	callback func(*SendResult, error)
+}
+
+// Done returns a channel which is closed when the result is available.
+func (f *SendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits for the message to be sent and returns the result.
+func (f *SendFuture) Result() (*SendResult, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// ResultWithContext is the same as Result, but stops waiting and returns the context error when the context is done. The
+// message is still sent with the batch.
+func (f *SendFuture) ResultWithContext(ctx aws.Context) (*SendResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *SendFuture) complete(result *SendResult, err error) {
+	f.result = result
+	f.err = err
+	close(f.done)
+
+	if f.callback != nil {
+		f.callback(result, err)
+	}
+}
+
+// pendingSend is a prepared message waiting in a BufferedSender.
+type pendingSend struct {
+	entry  *preparedEntry
+	size   int
+	result SendResult
+	future *SendFuture
+}
+
+// NewBufferedSender returns a BufferedSender sending to the queue. Close the sender when done to send the buffered messages.
+func (c *Client) NewBufferedSender(queueName *string, opt ...BufferedSenderOption) *BufferedSender {
+	opts := bufferedSenderOptions{
+		linger:        200 * time.Millisecond,
+		maxBatchSize:  maxBatchSize,
+		maxBatchBytes: maxMessageSize,
+	}
+
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	if opts.maxBatchSize < 1 || opts.maxBatchSize > maxBatchSize {
+		opts.maxBatchSize = maxBatchSize
+	}
+
+	if opts.maxBatchBytes < 1 || opts.maxBatchBytes > maxMessageSize {
+		opts.maxBatchBytes = maxMessageSize
+	}
+
+	s := &BufferedSender{
+		opts:      opts,
+		client:    c,
+		queueName: queueName,
+	}
+	s.batcher = newBatcher(opts.linger, opts.maxBatchSize, opts.maxBatchBytes, s.flush)
+
+	return s
+}
+
+// Send adds a message to the buffer. Convenient method for sending a message without custom attributes.
+func (s *BufferedSender) Send(payload []byte, opt ...SendOption) *SendFuture {
+	return s.SendWithAttributesWithContext(aws.BackgroundContext(), payload, nil, opt...)
+}
+
+// SendWithAttributes adds a message with attributes to the buffer.
+func (s *BufferedSender) SendWithAttributes(payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, opt ...SendOption) *SendFuture {
+	return s.SendWithAttributesWithContext(aws.BackgroundContext(), payload, messageAttributes, opt...)
+}
+
+// SendWithAttributesWithContext is the same as SendWithAttributes with the addition of a context. The context is passed on to
+// the calls to S3 and KMS made when the message is added. The batch is sent independently of the context.
+func (s *BufferedSender) SendWithAttributesWithContext(ctx aws.Context, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, opt ...SendOption) *SendFuture {
+	future := &SendFuture{done: make(chan struct{})}
+	s.send(ctx, payload, messageAttributes, opt, future)
+	return future
+}
+
+// SendWithCallback adds a message with attributes to the buffer. The callback is called with the result when the batch
+// containing the message has been sent, or right away if the message can't be added. The callback is called from the goroutine
+// sending the batch, so it should return quickly.
+func (s *BufferedSender) SendWithCallback(payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, callback func(*SendResult, error), opt ...SendOption) {
+	future := &SendFuture{
+		done:     make(chan struct{}),
+		callback: callback,
+	}
+	s.send(aws.BackgroundContext(), payload, messageAttributes, opt, future)
+}
+
+func (s *BufferedSender) send(ctx aws.Context, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, opt []SendOption, future *SendFuture) {
+	p := &pendingSend{future: future}
+
+	sendOpts := s.client.newSendOptions(s.queueName, payload, opt)
+	if err := validateFIFO(s.queueName, &sendOpts); err != nil {
+		future.complete(nil, err)
+		return
+	}
+
+	payld, messageAttributes, err := s.client.prepareMessage(ctx, payload, messageAttributes, &sendOpts, &p.result)
+	if err != nil {
+		future.complete(nil, err)
+		return
+	}
+
+	if err := validateMessage(payld, messageAttributes); err != nil {
+		s.client.deleteUnsentPayload(&p.result)
+		future.complete(nil, err)
+		return
+	}
+
+	p.entry = &preparedEntry{
+		payload:           payld,
+		messageAttributes: messageAttributes,
+		sendOpts:          sendOpts,
+	}
+	p.size = size(payld, messageAttributes)
+
+	if !s.batcher.add(p, p.size) {
+		s.client.deleteUnsentPayload(&p.result)
+		future.complete(nil, ErrorBufferedSenderClosed)
+	}
+}
+
+// Flush sends the buffered messages without waiting for the linger time and waits for the batch to be sent.
+func (s *BufferedSender) Flush() {
+	s.batcher.flush()
+}
+
+// Close sends the buffered messages and waits for all batches to be sent. Messages sent after Close fail with
+// ErrorBufferedSenderClosed.
+func (s *BufferedSender) Close() {
+	s.batcher.close()
+}
+
+// flush sends the batch and completes the future of each message.
+func (s *BufferedSender) flush(batch []*pendingSend) {
+	entries := make([]*preparedEntry, len(batch))
+	results := make([]BatchResult, len(batch))
+	for i, p := range batch {
+		p.entry.index = i
+		entries[i] = p.entry
+		results[i].SendResult = p.result
+	}
+
+	s.client.sendBatch(aws.BackgroundContext(), s.queueName, entries, results)
+
+	for i, p := range batch {
+		if results[i].Err != nil {
+			p.future.complete(nil, results[i].Err)
+		} else {
+			p.future.complete(&results[i].SendResult, nil)
+		}
+	}
+}
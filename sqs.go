@@ -5,6 +5,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"strconv"
 	"sync"
 )
 
@@ -21,14 +22,17 @@ var ErrorMaxMessageSizeExceeded = fmt.Errorf("maximum message size of %d bytes e
 // ErrorMaxNumberOfAttributesExceeded is returned when the number of attributes exceeds maxNumberOfAttributes.
 var ErrorMaxNumberOfAttributesExceeded = fmt.Errorf("maximum number of attributes of %d exceeded", maxNumberOfAttributes)
 
-func size(payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue) int {
-	size := len(payload)
+// validateMessage checks that a message is within the limits set by SQS.
+func validateMessage(payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue) error {
+	if len(messageAttributes) > maxNumberOfAttributes {
+		return ErrorMaxNumberOfAttributesExceeded
+	}
 
-	for key, value := range messageAttributes {
-		size += len(key) + len(*value.DataType) + len(*value.StringValue)
+	if size(payload, messageAttributes) > maxMessageSize {
+		return ErrorMaxMessageSizeExceeded
 	}
 
-	return size
+	return nil
 }
 
 type sqsClient struct {
@@ -46,33 +50,39 @@ func newSQSClient(awsSQS sqsiface.SQSAPI, opts *options) *sqsClient {
 	}
 }
 
-func (s *sqsClient) sendMessage(queueName *string, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue) error {
-	if len(messageAttributes) > maxNumberOfAttributes {
-		return ErrorMaxNumberOfAttributesExceeded
-	}
-
-	if size(payload, messageAttributes) > maxMessageSize {
-		return ErrorMaxMessageSizeExceeded
+func (s *sqsClient) sendMessage(ctx aws.Context, queueName *string, payload []byte, messageAttributes map[string]*sqs.MessageAttributeValue, sendOpts *sendOptions) (*sqs.SendMessageOutput, error) {
+	if err := validateMessage(payload, messageAttributes); err != nil {
+		return nil, err
 	}
 
-	queueURL, err := s.getQueueURL(queueName)
+	queueURL, err := s.getQueueURL(ctx, queueName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	smi := &sqs.SendMessageInput{
-		DelaySeconds:      &s.opts.delaySeconds,
-		MessageAttributes: messageAttributes,
-		MessageBody:       aws.String(string(payload)),
-		QueueUrl:          queueURL,
+		DelaySeconds:           delaySeconds(queueName, sendOpts),
+		MessageAttributes:      messageAttributes,
+		MessageBody:            aws.String(string(payload)),
+		MessageDeduplicationId: optionalString(sendOpts.messageDeduplicationID),
+		MessageGroupId:         optionalString(sendOpts.messageGroupID),
+		QueueUrl:               queueURL,
 	}
 
-	_, err = s.awsSQS.SendMessage(smi)
-	return err
+	return s.awsSQS.SendMessageWithContext(ctx, smi)
 }
 
-func (s *sqsClient) sendMessageBatch(queueName *string, entries []*sqs.SendMessageBatchRequestEntry) (*sqs.SendMessageBatchOutput, error) {
-	queueURL, err := s.getQueueURL(queueName)
+// delaySeconds returns the delay to set on a message sent to the queue. FIFO queues does not support delay on single messages.
+func delaySeconds(queueName *string, sendOpts *sendOptions) *int64 {
+	if isFIFOQueue(queueName) {
+		return nil
+	}
+
+	return aws.Int64(sendOpts.delaySeconds)
+}
+
+func (s *sqsClient) sendMessageBatch(ctx aws.Context, queueName *string, entries []*sqs.SendMessageBatchRequestEntry) (*sqs.SendMessageBatchOutput, error) {
+	queueURL, err := s.getQueueURL(ctx, queueName)
 	if err != nil {
 		return nil, err
 	}
@@ -82,30 +92,34 @@ func (s *sqsClient) sendMessageBatch(queueName *string, entries []*sqs.SendMessa
 		QueueUrl: queueURL,
 	}
 
-	return s.awsSQS.SendMessageBatch(sbo)
+	return s.awsSQS.SendMessageBatchWithContext(ctx, sbo)
 }
 
-func (s *sqsClient) receiveMessage(queueName *string) ([]*sqs.Message, error) {
-	queueURL, err := s.getQueueURL(queueName)
+func (s *sqsClient) receiveMessage(ctx aws.Context, queueName *string, maxNumberOfMessages int64) ([]*sqs.Message, error) {
+	queueURL, err := s.getQueueURL(ctx, queueName)
 	if err != nil {
 		return nil, err
 	}
 
 	rmi := &sqs.ReceiveMessageInput{
 		AttributeNames:        s.opts.attributeNames,
-		MaxNumberOfMessages:   &s.opts.maxNumberOfMessages,
+		MaxNumberOfMessages:   &maxNumberOfMessages,
 		MessageAttributeNames: s.opts.messageAttributeNames,
 		QueueUrl:              queueURL,
 		VisibilityTimeout:     &s.opts.initialVisibilityTimeout,
 		WaitTimeSeconds:       &s.opts.waitTimeSeconds,
 	}
 
-	output, err := s.awsSQS.ReceiveMessage(rmi)
-	return output.Messages, err
+	output, err := s.awsSQS.ReceiveMessageWithContext(ctx, rmi)
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Messages, nil
 }
 
-func (s *sqsClient) changeMessageVisibility(queueName *string, message *sqs.Message, timeout int64) error {
-	queueURL, err := s.getQueueURL(queueName)
+func (s *sqsClient) changeMessageVisibility(ctx aws.Context, queueName *string, message *sqs.Message, timeout int64) error {
+	queueURL, err := s.getQueueURL(ctx, queueName)
 	if err != nil {
 		return err
 	}
@@ -116,12 +130,12 @@ func (s *sqsClient) changeMessageVisibility(queueName *string, message *sqs.Mess
 		VisibilityTimeout: &timeout,
 	}
 
-	_, err = s.awsSQS.ChangeMessageVisibility(cmvi)
+	_, err = s.awsSQS.ChangeMessageVisibilityWithContext(ctx, cmvi)
 	return err
 }
 
-func (s *sqsClient) deleteMessage(queueName *string, receiptHandle *string) error {
-	queueURL, err := s.getQueueURL(queueName)
+func (s *sqsClient) deleteMessage(ctx aws.Context, queueName *string, receiptHandle *string) error {
+	queueURL, err := s.getQueueURL(ctx, queueName)
 	if err != nil {
 		return err
 	}
@@ -131,11 +145,132 @@ func (s *sqsClient) deleteMessage(queueName *string, receiptHandle *string) erro
 		ReceiptHandle: receiptHandle,
 	}
 
-	_, err = s.awsSQS.DeleteMessage(dmi)
+	_, err = s.awsSQS.DeleteMessageWithContext(ctx, dmi)
 	return err
 }
 
-func (s *sqsClient) getQueueURL(queueName *string) (*string, error) {
+// deleteMessageBatch deletes the messages in batches of maximum 10 messages. The returned errors are in the same order as the
+// receipt handles.
+func (s *sqsClient) deleteMessageBatch(ctx aws.Context, queueName *string, receiptHandles []*string) []error {
+	errs := make([]error, len(receiptHandles))
+
+	queueURL, err := s.getQueueURL(ctx, queueName)
+	if err != nil {
+		fillErrors(errs, err)
+		return errs
+	}
+
+	for start := 0; start < len(receiptHandles); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(receiptHandles) {
+			end = len(receiptHandles)
+		}
+
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, end-start)
+		for i, receiptHandle := range receiptHandles[start:end] {
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: receiptHandle,
+			}
+		}
+
+		dbi := &sqs.DeleteMessageBatchInput{
+			Entries:  entries,
+			QueueUrl: queueURL,
+		}
+
+		output, err := s.awsSQS.DeleteMessageBatchWithContext(ctx, dbi)
+		if err != nil {
+			fillErrors(errs[start:end], err)
+			continue
+		}
+
+		var successful []*string
+		for _, entry := range output.Successful {
+			successful = append(successful, entry.Id)
+		}
+
+		batchErrors(errs[start:end], "error deleting message in batch", successful, output.Failed)
+	}
+
+	return errs
+}
+
+// changeMessageVisibilityBatch changes the visibility of the messages in batches of maximum 10 messages. The returned errors are
+// in the same order as the messages.
+func (s *sqsClient) changeMessageVisibilityBatch(ctx aws.Context, queueName *string, messages []*sqs.Message, timeout int64) []error {
+	errs := make([]error, len(messages))
+
+	queueURL, err := s.getQueueURL(ctx, queueName)
+	if err != nil {
+		fillErrors(errs, err)
+		return errs
+	}
+
+	for start := 0; start < len(messages); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, end-start)
+		for i, message := range messages[start:end] {
+			entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     message.ReceiptHandle,
+				VisibilityTimeout: &timeout,
+			}
+		}
+
+		cbi := &sqs.ChangeMessageVisibilityBatchInput{
+			Entries:  entries,
+			QueueUrl: queueURL,
+		}
+
+		output, err := s.awsSQS.ChangeMessageVisibilityBatchWithContext(ctx, cbi)
+		if err != nil {
+			fillErrors(errs[start:end], err)
+			continue
+		}
+
+		var successful []*string
+		for _, entry := range output.Successful {
+			successful = append(successful, entry.Id)
+		}
+
+		batchErrors(errs[start:end], "error changing message visibility in batch", successful, output.Failed)
+	}
+
+	return errs
+}
+
+func fillErrors(errs []error, err error) {
+	for i := range errs {
+		errs[i] = err
+	}
+}
+
+// batchErrors writes the outcome of each entry of a batch to errs. The batch entry id is the position of the entry in the batch.
+func batchErrors(errs []error, prefix string, successful []*string, failed []*sqs.BatchResultErrorEntry) {
+	outcomes := make(map[string]error)
+	for _, id := range successful {
+		outcomes[aws.StringValue(id)] = nil
+	}
+
+	for _, entry := range failed {
+		outcomes[aws.StringValue(entry.Id)] = fmt.Errorf("%s: %s: %s", prefix, aws.StringValue(entry.Code), aws.StringValue(entry.Message))
+	}
+
+	for i := range errs {
+		if err, exists := outcomes[strconv.Itoa(i)]; exists {
+			errs[i] = err
+		} else {
+			errs[i] = ErrorMissingBatchResult
+		}
+	}
+}
+
+func (s *sqsClient) getQueueURL(ctx aws.Context, queueName *string) (*string, error) {
 	s.rwLock.RLock()
 	if value, exists := s.queueCache[*queueName]; exists {
 		s.rwLock.RUnlock()
@@ -145,10 +280,11 @@ func (s *sqsClient) getQueueURL(queueName *string) (*string, error) {
 
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
-	output, err := s.awsSQS.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: queueName})
-	if err == nil {
-		s.queueCache[*queueName] = *output.QueueUrl
+	output, err := s.awsSQS.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{QueueName: queueName})
+	if err != nil {
+		return nil, err
 	}
 
-	return output.QueueUrl, err
+	s.queueCache[*queueName] = *output.QueueUrl
+	return output.QueueUrl, nil
 }
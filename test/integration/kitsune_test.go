@@ -51,7 +51,7 @@ func TestClient_SendReceiveAndDeleteSingleMessage(t *testing.T) {
 	payload := uuid.New().String()
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s with Payload:\n%s", testQueueName, payload)
@@ -89,7 +89,7 @@ func TestClient_SendReceiveAndDeleteSingleMessageWithAttributes(t *testing.T) {
 	attributes["attribute3"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("TestAttribute3")}
 
 	// Send message
-	if err := sqsClient.SendMessageWithAttributes(&testQueueName, []byte(payload), attributes); err != nil {
+	if _, err := sqsClient.SendMessageWithAttributes(&testQueueName, []byte(payload), attributes); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s with Payload:\n%s", testQueueName, payload)
@@ -126,7 +126,7 @@ func TestClient_ExtendVisibilityTimeout(t *testing.T) {
 	payload := uuid.New().String()
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s with Payload:\n%s", testQueueName, payload)
@@ -184,7 +184,7 @@ func TestClient_SendReceiveAndDeleteLargeMessage(t *testing.T) {
 	test.AssertNotError(t, err)
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, payload); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, payload); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s.\n", testQueueName)
@@ -226,7 +226,7 @@ func TestClient_SendReceiveAndDeleteLargeMessageWithAttributes(t *testing.T) {
 	attributes["attribute4"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("TestAttribute4")}
 
 	// Send message
-	if err := sqsClient.SendMessageWithAttributes(&testQueueName, payload, attributes); err != nil {
+	if _, err := sqsClient.SendMessageWithAttributes(&testQueueName, payload, attributes); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s.\n", testQueueName)
@@ -260,7 +260,7 @@ func TestClient_SendReceiveAndDeleteSingleMessage_KMS(t *testing.T) {
 	payload := uuid.New().String()
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s with Payload:\n%s", testQueueName, payload)
@@ -293,7 +293,7 @@ func TestClient_SendReceiveAndDeleteLargeMessage_S3AndKMS(t *testing.T) {
 	test.AssertNotError(t, err)
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, payload); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, payload); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s.\n", testQueueName)
@@ -327,7 +327,7 @@ func TestClient_SendReceiveAndDeleteSingleMessage_CompressionEnabled(t *testing.
 	payload := uuid.New().String()
 
 	// Send message
-	if err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
+	if _, err := sqsClient.SendMessage(&testQueueName, []byte(payload)); err != nil {
 		t.Fatalf("Error sending message to SQS: %v ", err)
 	}
 	t.Logf("Sent message to queue: %s with Payload:\n%s", testQueueName, payload)
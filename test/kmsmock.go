@@ -4,9 +4,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"io"
+	"reflect"
 )
 
 var plaintTextKeys = []byte{55, 85, 145, 172, 39, 36, 22, 82, 172, 169, 243, 229, 20, 201, 150, 85, 108, 131, 94, 158, 249, 235, 14, 228, 31, 106, 82, 144, 180, 91, 16, 172}
@@ -18,23 +22,54 @@ type KmsMock struct {
 
 	GenerateDataKeyCalledCount int
 	DecryptCalledCount         int
+
+	// The encryption context of the last call to GenerateDataKey. Decrypt fails if called with a different encryption context.
+	EncryptionContext map[string]*string
+	// The key spec of the last call to GenerateDataKey. Decrypt returns a key of the same size.
+	KeySpec string
+
+	// Err is returned by GenerateDataKey and Decrypt if set. Used to simulate an outage.
+	Err error
+}
+
+// plaintextKey returns a copy of the static key truncated to the size of the key spec. The client overwrites keys when done.
+func (k *KmsMock) plaintextKey() []byte {
+	if k.KeySpec == kms.DataKeySpecAes128 {
+		return append([]byte(nil), plaintTextKeys[:16]...)
+	}
+
+	return append([]byte(nil), plaintTextKeys...)
 }
 
 // GenerateDataKey mock
 func (k *KmsMock) GenerateDataKey(gki *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
 	k.GenerateDataKeyCalledCount++
+	if k.Err != nil {
+		return nil, k.Err
+	}
+
+	k.EncryptionContext = gki.EncryptionContext
+	k.KeySpec = aws.StringValue(gki.KeySpec)
 	return &kms.GenerateDataKeyOutput{
 		CiphertextBlob: cipherTextKeys,
 		KeyId:          gki.KeyId,
-		Plaintext:      plaintTextKeys,
+		Plaintext:      k.plaintextKey(),
 	}, nil
 }
 
 // Decrypt mock
 func (k *KmsMock) Decrypt(di *kms.DecryptInput) (*kms.DecryptOutput, error) {
 	k.DecryptCalledCount++
+	if k.Err != nil {
+		return nil, k.Err
+	}
+
+	if !reflect.DeepEqual(aws.StringValueMap(k.EncryptionContext), aws.StringValueMap(di.EncryptionContext)) {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "encryption context does not match", nil)
+	}
+
 	return &kms.DecryptOutput{
-		Plaintext: plaintTextKeys,
+		Plaintext: k.plaintextKey(),
 	}, nil
 }
 
@@ -80,3 +115,21 @@ func DecryptData(data []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// GenerateDataKeyWithContext calls GenerateDataKey on the mock. Returns the context error if the context is done.
+func (k *KmsMock) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return k.GenerateDataKey(input)
+}
+
+// DecryptWithContext calls Decrypt on the mock. Returns the context error if the context is done.
+func (k *KmsMock) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return k.Decrypt(input)
+}
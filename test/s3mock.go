@@ -1,6 +1,8 @@
 package test
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -14,6 +16,9 @@ type S3Mock struct {
 
 	GetObjectHandler            func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	GetObjectHandlerCalledCount int
+
+	DeleteObjectHandler            func(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	DeleteObjectHandlerCalledCount int
 }
 
 // PutObject mocks S3 PutObject. Call the handler configured for the S3Mock object.
@@ -27,3 +32,36 @@ func (s *S3Mock) GetObject(goi *s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	s.GetObjectHandlerCalledCount++
 	return s.GetObjectHandler(goi)
 }
+
+// DeleteObject mocks S3 DeleteObject. Call the handler configured for the S3Mock object.
+func (s *S3Mock) DeleteObject(doi *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	s.DeleteObjectHandlerCalledCount++
+	return s.DeleteObjectHandler(doi)
+}
+
+// PutObjectWithContext calls PutObject on the mock. Returns the context error if the context is done.
+func (s *S3Mock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.PutObject(input)
+}
+
+// GetObjectWithContext calls GetObject on the mock. Returns the context error if the context is done.
+func (s *S3Mock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.GetObject(input)
+}
+
+// DeleteObjectWithContext calls DeleteObject on the mock. Returns the context error if the context is done.
+func (s *S3Mock) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.DeleteObject(input)
+}
@@ -1,10 +1,18 @@
 package test
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +24,24 @@ type SQSMock struct {
 	timeoutSec     int64
 	chanBufferSize int64
 
+	// SendMessageBatchCalledCount is guarded by a lock since batches can be sent from several goroutines. Use
+	// SendMessageBatchCalls to read it while the mock is in use.
+	SendMessageBatchCalledCount int
+	lock                        sync.Mutex
+
+	// DeleteMessageBatchCalledCount is updated atomically since batches can be deleted from several goroutines. Use
+	// atomic.LoadInt64 to read it.
+	DeleteMessageBatchCalledCount int64
+
+	// InvalidReceiptHandles are rejected by the batch operations as if the receipt handles were invalid. Set before the mock is
+	// in use.
+	InvalidReceiptHandles map[string]bool
+
+	// ChangeMessageVisibilityErr is returned by ChangeMessageVisibility if set. Set before the mock is in use.
+	ChangeMessageVisibilityErr error
+
+	sequenceNumber int64
+
 	sendMessageRequests             map[string]chan *sqs.SendMessageInput
 	changeMessageVisibilityRequests map[string]chan *sqs.ChangeMessageVisibilityInput
 	deleteMessageRequests           map[string]chan *sqs.DeleteMessageInput
@@ -35,9 +61,16 @@ func NewSQSMock(timeoutSec int64, chanBufferSize int64) *SQSMock {
 
 // SendMessage sends a message to the mock.
 func (sm *SQSMock) SendMessage(smi *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if err := validateFIFO(smi); err != nil {
+		return nil, err
+	}
+
 	if c, exists := sm.sendMessageRequests[*smi.QueueUrl]; exists {
 		c <- smi
-		return &sqs.SendMessageOutput{}, nil
+		return &sqs.SendMessageOutput{
+			MD5OfMessageBody: md5OfBody(smi.MessageBody),
+			MessageId:        aws.String(uuid.New().String()),
+		}, nil
 	}
 
 	return nil, errors.New("queue doesnt exist")
@@ -45,15 +78,36 @@ func (sm *SQSMock) SendMessage(smi *sqs.SendMessageInput) (*sqs.SendMessageOutpu
 
 // SendMessageBatch sends a batch to the mock.
 func (sm *SQSMock) SendMessageBatch(sbi *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	sm.lock.Lock()
+	sm.SendMessageBatchCalledCount++
+	sm.lock.Unlock()
+
 	var output sqs.SendMessageBatchOutput
 	for _, entry := range sbi.Entries {
 		if c, exists := sm.sendMessageRequests[*sbi.QueueUrl]; exists {
-			c <- &sqs.SendMessageInput{
-				MessageBody:       entry.MessageBody,
-				MessageAttributes: entry.MessageAttributes,
+			smi := &sqs.SendMessageInput{
+				DelaySeconds:           entry.DelaySeconds,
+				MessageAttributes:      entry.MessageAttributes,
+				MessageBody:            entry.MessageBody,
+				MessageDeduplicationId: entry.MessageDeduplicationId,
+				MessageGroupId:         entry.MessageGroupId,
+				QueueUrl:               sbi.QueueUrl,
 			}
+			if err := validateFIFO(smi); err != nil {
+				output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+					Code:        aws.String("InvalidParameterValue"),
+					Id:          entry.Id,
+					Message:     aws.String(err.Error()),
+					SenderFault: aws.Bool(true),
+				})
+				continue
+			}
+
+			c <- smi
 			output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{
-				Id: entry.Id,
+				Id:               entry.Id,
+				MD5OfMessageBody: md5OfBody(entry.MessageBody),
+				MessageId:        aws.String(uuid.New().String()),
 			})
 		} else {
 			return nil, errors.New("queue doesnt exist")
@@ -63,6 +117,37 @@ func (sm *SQSMock) SendMessageBatch(sbi *sqs.SendMessageBatchInput) (*sqs.SendMe
 	return &output, nil
 }
 
+// SendMessageBatchCalls returns the number of calls to SendMessageBatch. Safe to call while batches are being sent.
+func (sm *SQSMock) SendMessageBatchCalls() int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	return sm.SendMessageBatchCalledCount
+}
+
+func md5OfBody(body *string) *string {
+	sum := md5.Sum([]byte(*body))
+	return aws.String(hex.EncodeToString(sum[:]))
+}
+
+// validateFIFO rejects messages to FIFO queues which SQS would reject. That is messages without a message group id or with delay
+// set on the message.
+func validateFIFO(smi *sqs.SendMessageInput) error {
+	if !strings.HasSuffix(*smi.QueueUrl, ".fifo") {
+		return nil
+	}
+
+	if smi.MessageGroupId == nil {
+		return errors.New("message group id is required for FIFO queues")
+	}
+
+	if smi.DelaySeconds != nil {
+		return errors.New("delay seconds is not supported on messages sent to FIFO queues")
+	}
+
+	return nil
+}
+
 // ReceiveMessage receives a message from the mock.
 func (sm *SQSMock) ReceiveMessage(rmi *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
 	rmo := &sqs.ReceiveMessageOutput{}
@@ -75,9 +160,20 @@ func (sm *SQSMock) ReceiveMessage(rmi *sqs.ReceiveMessageInput) (*sqs.ReceiveMes
 	for {
 		select {
 		case messageInput := <-c:
+			attributes := map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("1")}
+			if messageInput.MessageGroupId != nil {
+				attributes[sqs.MessageSystemAttributeNameMessageGroupId] = messageInput.MessageGroupId
+				attributes[sqs.MessageSystemAttributeNameSequenceNumber] = aws.String(strconv.FormatInt(atomic.AddInt64(&sm.sequenceNumber, 1), 10))
+			}
+			if messageInput.MessageDeduplicationId != nil {
+				attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId] = messageInput.MessageDeduplicationId
+			}
+
 			rmo.Messages = append(rmo.Messages, &sqs.Message{
+				Attributes:        attributes,
 				Body:              messageInput.MessageBody,
 				MessageAttributes: messageInput.MessageAttributes,
+				ReceiptHandle:     aws.String(uuid.New().String()),
 			})
 
 			if len(rmo.Messages) == int(*rmi.MaxNumberOfMessages) {
@@ -91,6 +187,10 @@ func (sm *SQSMock) ReceiveMessage(rmi *sqs.ReceiveMessageInput) (*sqs.ReceiveMes
 
 // ChangeMessageVisibility sends a request to change a messages visibility to the mock.
 func (sm *SQSMock) ChangeMessageVisibility(cmvi *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if sm.ChangeMessageVisibilityErr != nil {
+		return nil, sm.ChangeMessageVisibilityErr
+	}
+
 	if c, exists := sm.changeMessageVisibilityRequests[*cmvi.QueueUrl]; exists {
 		c <- cmvi
 		return &sqs.ChangeMessageVisibilityOutput{}, nil
@@ -109,17 +209,77 @@ func (sm *SQSMock) DeleteMessage(dmi *sqs.DeleteMessageInput) (*sqs.DeleteMessag
 	return nil, errors.New("queue doesnt exist")
 }
 
+// DeleteMessageBatch sends a delete message request for each entry to the mock.
+func (sm *SQSMock) DeleteMessageBatch(dbi *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	atomic.AddInt64(&sm.DeleteMessageBatchCalledCount, 1)
+
+	c, exists := sm.deleteMessageRequests[*dbi.QueueUrl]
+	if !exists {
+		return nil, errors.New("queue doesnt exist")
+	}
+
+	var output sqs.DeleteMessageBatchOutput
+	for _, entry := range dbi.Entries {
+		if sm.InvalidReceiptHandles[aws.StringValue(entry.ReceiptHandle)] {
+			output.Failed = append(output.Failed, invalidReceiptHandle(entry.Id))
+			continue
+		}
+
+		c <- &sqs.DeleteMessageInput{
+			QueueUrl:      dbi.QueueUrl,
+			ReceiptHandle: entry.ReceiptHandle,
+		}
+		output.Successful = append(output.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+
+	return &output, nil
+}
+
+// ChangeMessageVisibilityBatch sends a request to change visibility for each entry to the mock.
+func (sm *SQSMock) ChangeMessageVisibilityBatch(cbi *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	c, exists := sm.changeMessageVisibilityRequests[*cbi.QueueUrl]
+	if !exists {
+		return nil, errors.New("queue doesnt exist")
+	}
+
+	var output sqs.ChangeMessageVisibilityBatchOutput
+	for _, entry := range cbi.Entries {
+		if sm.InvalidReceiptHandles[aws.StringValue(entry.ReceiptHandle)] {
+			output.Failed = append(output.Failed, invalidReceiptHandle(entry.Id))
+			continue
+		}
+
+		c <- &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          cbi.QueueUrl,
+			ReceiptHandle:     entry.ReceiptHandle,
+			VisibilityTimeout: entry.VisibilityTimeout,
+		}
+		output.Successful = append(output.Successful, &sqs.ChangeMessageVisibilityBatchResultEntry{Id: entry.Id})
+	}
+
+	return &output, nil
+}
+
+func invalidReceiptHandle(id *string) *sqs.BatchResultErrorEntry {
+	return &sqs.BatchResultErrorEntry{
+		Code:        aws.String(sqs.ErrCodeReceiptHandleIsInvalid),
+		Id:          id,
+		Message:     aws.String("the receipt handle is not valid"),
+		SenderFault: aws.Bool(true),
+	}
+}
+
 // CreateQueueIfNotExists will create a queue representation on the mock if one with the same name doesnt already exist.
 func (sm *SQSMock) CreateQueueIfNotExists(queueURL *string) {
 	if _, exists := sm.sendMessageRequests[*queueURL]; !exists {
 		sm.sendMessageRequests[*queueURL] = make(chan *sqs.SendMessageInput, sm.chanBufferSize)
 	}
 
-	if _, exists := sm.sendMessageRequests[*queueURL]; !exists {
+	if _, exists := sm.changeMessageVisibilityRequests[*queueURL]; !exists {
 		sm.changeMessageVisibilityRequests[*queueURL] = make(chan *sqs.ChangeMessageVisibilityInput, sm.chanBufferSize)
 	}
 
-	if _, exists := sm.sendMessageRequests[*queueURL]; !exists {
+	if _, exists := sm.deleteMessageRequests[*queueURL]; !exists {
 		sm.deleteMessageRequests[*queueURL] = make(chan *sqs.DeleteMessageInput, sm.chanBufferSize)
 	}
 }
@@ -154,6 +314,28 @@ func (sm *SQSMock) WaitUntilMessageDeleted(queueURL *string, count int) error {
 	}
 }
 
+// WaitUntilMessageVisibilityChanged will wait until count change message visibility requests are received by the mock. Will time
+// out after a configurable amount of time and return an error.
+func (sm *SQSMock) WaitUntilMessageVisibilityChanged(queueURL *string, count int) ([]*sqs.ChangeMessageVisibilityInput, error) {
+	var requests []*sqs.ChangeMessageVisibilityInput
+	c, exists := sm.changeMessageVisibilityRequests[*queueURL]
+	if !exists {
+		return nil, errors.New("queue doesnt exist")
+	}
+
+	for {
+		select {
+		case request := <-c:
+			requests = append(requests, request)
+			if len(requests) == count {
+				return requests, nil
+			}
+		case <-time.After(time.Duration(sm.timeoutSec) * time.Second):
+			return nil, errors.New("timed out waiting for message visibility to be changed")
+		}
+	}
+}
+
 // WaitUntilMessagesReceived waits until count messages are received and returns the received messages. Will time out after a
 // configurable amount of time and return an error.
 func (sm *SQSMock) WaitUntilMessagesReceived(queueURL *string, count int) ([]*sqs.Message, error) {
@@ -181,3 +363,76 @@ func (sm *SQSMock) WaitUntilMessagesReceived(queueURL *string, count int) ([]*sq
 
 	return messages, nil
 }
+
+// SendMessageWithContext calls SendMessage on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.SendMessage(input)
+}
+
+// SendMessageBatchWithContext calls SendMessageBatch on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.SendMessageBatch(input)
+}
+
+// ReceiveMessageWithContext calls ReceiveMessage on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.ReceiveMessage(input)
+}
+
+// ChangeMessageVisibilityWithContext calls ChangeMessageVisibility on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.ChangeMessageVisibility(input)
+}
+
+// DeleteMessageWithContext calls DeleteMessage on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.DeleteMessage(input)
+}
+
+// DeleteMessageBatchWithContext calls DeleteMessageBatch on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) DeleteMessageBatchWithContext(ctx aws.Context, input *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.DeleteMessageBatch(input)
+}
+
+// ChangeMessageVisibilityBatchWithContext calls ChangeMessageVisibilityBatch on the mock. Returns the context error if the
+// context is done.
+func (sm *SQSMock) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.ChangeMessageVisibilityBatch(input)
+}
+
+// GetQueueUrlWithContext calls GetQueueUrl on the mock. Returns the context error if the context is done.
+func (sm *SQSMock) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return sm.GetQueueUrl(input)
+}
@@ -0,0 +1,169 @@
+package kitsune
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrorInvalidVaultKeyID is returned by the VaultTransitKeyProvider when the key id is empty or contains "/" or "..". The key id
+// of a received message is read from the message, so it is not allowed to change which Vault endpoint is called.
+var ErrorInvalidVaultKeyID = errors.New("invalid vault transit key id")
+
+// VaultTransitKeyProvider is a KeyProvider generating and decrypting data keys using the transit secrets engine of HashiCorp
+// Vault. The key id is the name of a transit key. A non-empty encryption context is passed as the key derivation context, so
+// the transit key has to be created with derivation enabled when encryption contexts are used.
+type VaultTransitKeyProvider struct {
+	// Address of the Vault server, eg. https://vault.example.com:8200
+	Address string
+	// Token used to authenticate
+	Token string
+	// Namespace is set as the Vault namespace if not empty
+	Namespace string
+	// Mount is the path the transit secrets engine is mounted at. Default is transit
+	Mount string
+	// HTTPClient used to call Vault. Default is http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// NewVaultTransitKeyProvider returns a provider calling the Vault server at the address, authenticating with the token.
+func NewVaultTransitKeyProvider(address string, token string) *VaultTransitKeyProvider {
+	return &VaultTransitKeyProvider{
+		Address: address,
+		Token:   token,
+	}
+}
+
+type vaultRequest struct {
+	Bits       int    `json:"bits,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Context    string `json:"context,omitempty"`
+}
+
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// GenerateDataKey generates a data key using the datakey endpoint of the transit key with the id.
+func (p *VaultTransitKeyProvider) GenerateDataKey(ctx aws.Context, keyID string, keySpec string, encryptionContext map[string]string) (*DataKey, error) {
+	size, err := keySpecSize(keySpec)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := vaultKeyPath(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	vr, err := p.call(ctx, "datakey/plaintext/"+key, &vaultRequest{
+		Bits:    size * 8,
+		Context: vaultContext(encryptionContext),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(vr.Data.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyID:        keyID,
+		Plaintext:    plaintext,
+		EncryptedKey: []byte(vr.Data.Ciphertext),
+	}, nil
+}
+
+// Decrypt decrypts the data key using the decrypt endpoint of the transit key with the id.
+func (p *VaultTransitKeyProvider) Decrypt(ctx aws.Context, keyID string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	key, err := vaultKeyPath(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	vr, err := p.call(ctx, "decrypt/"+key, &vaultRequest{
+		Ciphertext: string(encryptedKey),
+		Context:    vaultContext(encryptionContext),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(vr.Data.Plaintext)
+}
+
+func (p *VaultTransitKeyProvider) call(ctx aws.Context, path string, request *vaultRequest) (*vaultResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := p.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.Address, "/")+"/v1/"+mount+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	httpClient := p.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	vr := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil {
+		return nil, fmt.Errorf("error decoding response from vault: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error calling vault: %s: %s", resp.Status, strings.Join(vr.Errors, ", "))
+	}
+
+	return vr, nil
+}
+
+// vaultKeyPath returns the key id escaped for use as a path segment.
+func vaultKeyPath(keyID string) (string, error) {
+	if keyID == "" || strings.Contains(keyID, "/") || strings.Contains(keyID, "..") {
+		return "", ErrorInvalidVaultKeyID
+	}
+
+	return url.PathEscape(keyID), nil
+}
+
+// vaultContext returns the encryption context as a base64 encoded key derivation context.
+func vaultContext(encryptionContext map[string]string) string {
+	aad := encryptionContextAAD(encryptionContext)
+	if aad == nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(aad)
+}